@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aemengo/bosh-deployment-dashboard/config"
 	"github.com/aemengo/bosh-deployment-dashboard/system"
@@ -15,28 +16,53 @@ import (
 	"github.com/aemengo/bosh-deployment-dashboard/info"
 )
 
+// version is overridden at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// hubClient gives up on a hub that does not answer, so that neither the
+// reports nor a pre-stop script hang on it.
+var hubClient = &http.Client{Timeout: 5 * time.Second}
+
 func main() {
 	logger := log.New(os.Stdout, "[BDD-A] ", log.LstdFlags)
 
-	if len(os.Args) != 2 {
-		logger.Fatalf("[USAGE] %s /path/to/config.yml\n", os.Args[0])
+	preStop := len(os.Args) == 3 && os.Args[1] == "pre-stop"
+
+	if len(os.Args) != 2 && !preStop {
+		logger.Fatalf("[USAGE] %s [pre-stop] /path/to/config.yml\n", os.Args[0])
 	}
 
-	configPath := os.Args[1]
+	configPath := os.Args[len(os.Args)-1]
 
 	cfg, err := config.NewConfig(configPath)
 	if err != nil {
 		logger.Fatalf("Error %s\n", err)
 	}
 
+	// BOSH runs pre-stop scripts before stopping the jobs of an instance,
+	// telling them whether its VM is deleted afterwards. Monit stopping
+	// the agent, as on every deploy, leaves the instance registered, and
+	// the hub prunes instances that stop reporting otherwise.
+	if preStop {
+		if os.Getenv("BOSH_VM_NEXT_STATE") == "delete" {
+			deregister(cfg, logger)
+		}
+		return
+	}
+
 	tickerChan := time.NewTicker(10 * time.Second)
+	inventoryTickerChan := time.NewTicker(5 * time.Minute)
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 
+	sendInventory(cfg, logger)
+
 	for {
 		select {
 		case <-tickerChan.C:
 			sendVMInformation(cfg, logger)
+		case <-inventoryTickerChan.C:
+			sendInventory(cfg, logger)
 		case <-signalChan:
 			logger.Println("Shutting down now...")
 			return
@@ -57,17 +83,71 @@ func sendVMInformation(cfg config.Config, logger *log.Logger) {
 		Stats: stats,
 	}
 
-	contents, _ := json.Marshal(i)
+	if err := postToHub(cfg, "/api/health", i); err != nil {
+		logger.Printf("Error sending metrics to hub at: %s: %s\n", cfg.Hub.Addr(), err)
+	}
+}
 
-	url := fmt.Sprintf("http://%s/api/health", cfg.Hub.Addr())
-	response, err := http.Post(url, "application/json", bytes.NewReader(contents))
+func sendInventory(cfg config.Config, logger *log.Logger) {
+	inventory, err := system.GetInventory()
 	if err != nil {
-		logger.Printf("Error sending metrics to hub at: %s: %s\n", cfg.Hub.Addr(), err)
+		logger.Printf("Error retrieving system inventory: %s\n", err)
 		return
 	}
+	inventory.AgentVersion = version
 
-	if response.StatusCode != http.StatusOK {
-		logger.Printf("Failed sending metrics to hub at: %s: %s\n", cfg.Hub.Addr(), response.Status)
+	inventory.ConfigHashes, err = system.HashJobConfigs(cfg.JobConfig.Include, cfg.JobConfig.Exclude)
+	if err != nil {
+		logger.Printf("Error hashing job configuration: %s\n", err)
+	}
+
+	i := info.InventoryInfo{
+		Spec:      cfg.Spec,
+		Label:     cfg.Label,
+		Inventory: inventory,
+	}
+
+	if err := postToHub(cfg, "/api/inventory", i); err != nil {
+		logger.Printf("Error sending inventory to hub at: %s: %s\n", cfg.Hub.Addr(), err)
+	}
+}
+
+// deregister removes this instance from the hub, so that a VM deleted with
+// its deployment or scaled down does not linger as stale.
+func deregister(cfg config.Config, logger *log.Logger) {
+	url := fmt.Sprintf("http://%s/api/health/%s", cfg.Hub.Addr(), cfg.Spec.ID)
+
+	request, err := http.NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		logger.Printf("Error deregistering from hub at: %s: %s\n", cfg.Hub.Addr(), err)
+		return
+	}
+
+	response, err := hubClient.Do(request)
+	if err != nil {
+		logger.Printf("Error deregistering from hub at: %s: %s\n", cfg.Hub.Addr(), err)
 		return
 	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusNotFound {
+		logger.Printf("Error deregistering from hub at: %s: %s\n", cfg.Hub.Addr(), response.Status)
+	}
+}
+
+func postToHub(cfg config.Config, path string, body interface{}) error {
+	contents, _ := json.Marshal(body)
+
+	url := fmt.Sprintf("http://%s%s", cfg.Hub.Addr(), path)
+	response, err := hubClient.Post(url, "application/json", bytes.NewReader(contents))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return errors.New(response.Status)
+	}
+
+	return nil
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const acknowledgementsSchema = `
+	create table if not exists acknowledgements (
+	  id integer not null primary key,
+	  alert_id integer not null,
+	  action text not null,
+	  owner text not null default '',
+	  comment text not null default '',
+	  created_at timestamp default current_timestamp not null
+	);
+	`
+
+const (
+	ackAcknowledged = "acknowledged"
+	ackCleared      = "cleared"
+)
+
+// Acknowledgement records someone taking ownership of an alert, or the
+// acknowledgement being cleared again, either by hand or because the alert
+// resolved.
+type Acknowledgement struct {
+	ID        int       `json:"id" db:"id"`
+	AlertID   int       `json:"alert_id" db:"alert_id"`
+	Action    string    `json:"action" db:"action"`
+	Owner     string    `json:"owner" db:"owner"`
+	Comment   string    `json:"comment" db:"comment"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+func migrateAlertsForAcknowledgements(dbClient *sqlx.DB) error {
+	columns := [][2]string{
+		{"acknowledged_by", "text not null default ''"},
+		{"acknowledged_at", "timestamp"},
+		{"ack_comment", "text not null default ''"},
+		{"notified_at", "timestamp"},
+	}
+
+	for _, c := range columns {
+		if err := addColumn(dbClient, "alerts", c[0], c[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleAlert serves /api/alerts/{id} and /api/alerts/{id}/ack.
+func handleAlert(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, logger *log.Logger) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/alerts/"), "/")
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) > 2 || (len(parts) == 2 && parts[1] != "ack") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var alert Alert
+	err = dbClient.Get(&alert, "select * from alerts where id = $1", id)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Printf("Error retrieving alert %d from DB: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		handleGetAlert(w, alert, dbClient, logger)
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		handlePostAck(w, r, alert, dbClient, logger)
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		handleDeleteAck(w, alert, dbClient, logger)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func handleGetAlert(w http.ResponseWriter, alert Alert, dbClient *sqlx.DB, logger *log.Logger) {
+	err := dbClient.Select(&alert.Acknowledgements, "select * from acknowledgements where alert_id = $1 order by id", alert.ID)
+	if err != nil {
+		logger.Printf("Error retrieving acknowledgements of alert %d from DB: %s\n", alert.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alert)
+}
+
+func handlePostAck(w http.ResponseWriter, r *http.Request, alert Alert, dbClient *sqlx.DB, logger *log.Logger) {
+	var ack Acknowledgement
+
+	if err := json.NewDecoder(r.Body).Decode(&ack); err != nil {
+		logger.Printf("Error reading json body of request: %s\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if ack.Owner == "" {
+		logger.Printf("Error acknowledgement of alert %d is missing an owner\n", alert.ID)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if alert.State != alertFiring {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	if err := acknowledgeAlert(dbClient, alert.ID, ack.Owner, ack.Comment); err != nil {
+		logger.Printf("Error acknowledging alert %d: %s\n", alert.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	logger.Printf("Alert %d (%s on %s) acknowledged by %s\n", alert.ID, alert.Rule, alert.InstanceID, ack.Owner)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
+}
+
+func handleDeleteAck(w http.ResponseWriter, alert Alert, dbClient *sqlx.DB, logger *log.Logger) {
+	if alert.AcknowledgedBy == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := clearAcknowledgement(dbClient, alert, "cleared by hand"); err != nil {
+		logger.Printf("Error clearing acknowledgement of alert %d: %s\n", alert.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
+}
+
+func acknowledgeAlert(dbClient *sqlx.DB, alertID int, owner string, comment string) error {
+	tx, err := dbClient.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"update alerts set acknowledged_by = $1, acknowledged_at = $2, ack_comment = $3 where id = $4",
+		owner, sqlTime(time.Now()), comment, alertID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := writeAcknowledgementToDB(tx, alertID, ackAcknowledged, owner, comment); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func clearAcknowledgement(dbClient *sqlx.DB, alert Alert, comment string) error {
+	tx, err := dbClient.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("update alerts set acknowledged_by = '', acknowledged_at = null, ack_comment = '' where id = $1", alert.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := writeAcknowledgementToDB(tx, alert.ID, ackCleared, alert.AcknowledgedBy, comment); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func writeAcknowledgementToDB(tx *sqlx.Tx, alertID int, action string, owner string, comment string) error {
+	_, err := tx.Exec(
+		"insert into acknowledgements (alert_id, action, owner, comment) values ($1, $2, $3, $4)",
+		alertID, action, owner, comment,
+	)
+	return err
+}
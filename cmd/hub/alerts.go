@@ -0,0 +1,420 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/aemengo/bosh-deployment-dashboard/config"
+	"github.com/aemengo/bosh-deployment-dashboard/info"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"time"
+)
+
+const alertsSchema = `
+	create table if not exists alerts (
+	  id integer not null primary key,
+	  instance_id text not null,
+	  deployment text,
+	  name text,
+	  instance_index integer,
+	  label text,
+	  az text,
+	  rule text not null,
+	  severity text,
+	  stat text,
+	  threshold real,
+	  value real,
+	  state text not null,
+	  fired_at timestamp default current_timestamp not null,
+	  resolved_at timestamp
+	);
+	`
+
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+
+	ruleTypeThreshold = "threshold"
+	ruleTypeOutlier   = "outlier"
+	ruleTypeForecast  = "forecast"
+	ruleTypeBaseline  = "baseline"
+)
+
+type Alert struct {
+	ID            int        `json:"id" db:"id"`
+	InstanceID    string     `json:"instance_id" db:"instance_id"`
+	Deployment    string     `json:"deployment" db:"deployment"`
+	Name          string     `json:"name" db:"name"`
+	InstanceIndex int        `json:"instance_index" db:"instance_index"`
+	Label         string     `json:"label" db:"label"`
+	AZ            string     `json:"az" db:"az"`
+	Rule          string     `json:"rule" db:"rule"`
+	RuleType      string     `json:"rule_type" db:"rule_type"`
+	Severity      string     `json:"severity" db:"severity"`
+	Stat          string     `json:"stat" db:"stat"`
+	Threshold     float64    `json:"threshold" db:"threshold"`
+	Value         float64    `json:"value" db:"value"`
+	Score         float64    `json:"score,omitempty" db:"score"`
+	State         string     `json:"state" db:"state"`
+	FiredAt       time.Time  `json:"fired_at" db:"fired_at"`
+	ResolvedAt    *time.Time `json:"resolved_at,omitempty" db:"resolved_at"`
+	NotifiedAt    *time.Time `json:"notified_at,omitempty" db:"notified_at"`
+	Flapping      bool       `json:"flapping" db:"flapping"`
+
+	AcknowledgedBy   string            `json:"acknowledged_by,omitempty" db:"acknowledged_by"`
+	AcknowledgedAt   *time.Time        `json:"acknowledged_at,omitempty" db:"acknowledged_at"`
+	AckComment       string            `json:"ack_comment,omitempty" db:"ack_comment"`
+	Acknowledgements []Acknowledgement `json:"acknowledgements,omitempty" db:"-"`
+}
+
+func statValue(metrics Metrics, stat string) (float64, bool) {
+	switch stat {
+	case "cpu_used":
+		return metrics.CpuUsed, true
+	case "memory_used":
+		return metrics.MemoryUsed, true
+	case "persistent_disk_used":
+		return metrics.PersistentDiskUsed, true
+	case "load_15":
+		return metrics.Load15, true
+	default:
+		return 0, false
+	}
+}
+
+func validateAlertRules(rules []config.AlertRule) error {
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return fmt.Errorf("alert rule for stat %q is missing a name", rule.Stat)
+		}
+
+		if _, ok := statValue(Metrics{}, rule.Stat); !ok {
+			return fmt.Errorf("alert rule %s has unknown stat %q", rule.Name, rule.Stat)
+		}
+
+		switch rule.Type {
+		case "", ruleTypeThreshold, ruleTypeOutlier, ruleTypeBaseline:
+		case ruleTypeForecast:
+			if rule.Within <= 0 {
+				return fmt.Errorf("forecast alert rule %s is missing within", rule.Name)
+			}
+		default:
+			return fmt.Errorf("alert rule %s has unknown type %q", rule.Name, rule.Type)
+		}
+	}
+	return nil
+}
+
+func ruleApplies(rule config.AlertRule, systemInfo info.Info) bool {
+	if rule.Deployment != "" && rule.Deployment != systemInfo.Spec.Deployment {
+		return false
+	}
+
+	if rule.Label != "" && rule.Label != systemInfo.Label {
+		return false
+	}
+
+	return true
+}
+
+// evaluateAlerts fires and resolves the alerts of an instance against its
+// latest report and returns the alerts that changed state.
+func evaluateAlerts(dbClient *sqlx.DB, cfg config.Hub, systemInfo info.Info) ([]Alert, error) {
+	var changed []Alert
+
+	metrics := metricsFromInfo(systemInfo)
+
+	for _, rule := range cfg.Alerts {
+		if !ruleApplies(rule, systemInfo) {
+			continue
+		}
+
+		value, _ := statValue(metrics, rule.Stat)
+		breached := value > rule.Threshold
+
+		var score float64
+		switch rule.Type {
+		case ruleTypeForecast:
+			forecast, ok, err := getForecast(dbClient, cfg, systemInfo.Spec.ID, rule.Stat)
+			if err != nil {
+				return nil, err
+			}
+
+			breached = ok && forecast.HoursToFull != nil && forecast.Confidence >= minForecastConfidence &&
+				*forecast.HoursToFull <= rule.Within.Hours()
+			if breached {
+				score = *forecast.HoursToFull
+			}
+		case ruleTypeBaseline:
+			threshold := rule.Threshold
+			if threshold == 0 {
+				threshold = cfg.Baseline.Sigma
+			}
+
+			b, ok, err := getBaseline(dbClient, cfg, systemInfo.Spec.ID, rule.Stat)
+			if err != nil {
+				return nil, err
+			}
+
+			if ok {
+				score = b.score(value)
+			}
+			breached = ok && score > threshold
+		case ruleTypeOutlier:
+			threshold := rule.Threshold
+			if threshold == 0 {
+				threshold = defaultOutlierScore
+			}
+
+			var (
+				ok  bool
+				err error
+			)
+			if score, ok, err = peerOutlierScore(dbClient, cfg, metrics, rule.Stat); err != nil {
+				return nil, err
+			}
+
+			breached = ok && score > threshold
+		}
+
+		var alert Alert
+		err := dbClient.Get(&alert, "select * from alerts where instance_id = $1 and rule = $2 and state = $3", systemInfo.Spec.ID, rule.Name, alertFiring)
+
+		switch {
+		case err == sql.ErrNoRows && breached:
+			id, err := writeAlertToDB(dbClient, rule, systemInfo, value, score)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := dbClient.Get(&alert, "select * from alerts where id = $1", id); err != nil {
+				return nil, err
+			}
+			changed = append(changed, alert)
+		case err == sql.ErrNoRows:
+		case err != nil:
+			return nil, err
+		case breached:
+			if _, err := dbClient.Exec("update alerts set value = $1, score = $2 where id = $3", value, score, alert.ID); err != nil {
+				return nil, err
+			}
+		default:
+			if _, err := dbClient.Exec("update alerts set value = $1, score = $2, state = $3, resolved_at = current_timestamp where id = $4", value, score, alertResolved, alert.ID); err != nil {
+				return nil, err
+			}
+
+			if alert.AcknowledgedBy != "" {
+				if err := clearAcknowledgement(dbClient, alert, "alert resolved"); err != nil {
+					return nil, err
+				}
+			}
+
+			alert.Value = value
+			alert.Score = score
+			alert.State = alertResolved
+			changed = append(changed, alert)
+		}
+	}
+
+	return changed, nil
+}
+
+func alertEvent(alert Alert) Event {
+	e := Event{
+		InstanceID:    alert.InstanceID,
+		Deployment:    alert.Deployment,
+		Name:          alert.Name,
+		InstanceIndex: alert.InstanceIndex,
+	}
+
+	switch {
+	case alert.State == alertFiring && alert.RuleType == ruleTypeOutlier:
+		e.Kind = eventAlertFired
+		e.Message = fmt.Sprintf("%s: %s is %.2f, an outlier among its peers with score %.2f", alert.Rule, alert.Stat, alert.Value, alert.Score)
+	case alert.State == alertFiring && alert.RuleType == ruleTypeBaseline:
+		e.Kind = eventAlertFired
+		e.Message = fmt.Sprintf("%s: %s is %.2f, %.1f sigma above its usual value at this hour", alert.Rule, alert.Stat, alert.Value, alert.Score)
+	case alert.State == alertFiring && alert.RuleType == ruleTypeForecast:
+		e.Kind = eventAlertFired
+		e.Message = fmt.Sprintf("%s: %s is %.2f, predicted to reach 100 in %.0fh", alert.Rule, alert.Stat, alert.Value, alert.Score)
+	case alert.State == alertFiring:
+		e.Kind = eventAlertFired
+		e.Message = fmt.Sprintf("%s: %s is %.2f, above %.2f", alert.Rule, alert.Stat, alert.Value, alert.Threshold)
+	default:
+		e.Kind = eventAlertResolved
+		e.Message = fmt.Sprintf("%s: %s is back to %.2f", alert.Rule, alert.Stat, alert.Value)
+	}
+
+	return e
+}
+
+// runAlertRepeater notifies again about alerts that are still firing after
+// the repeat interval, unless someone acknowledged them. With a routing
+// tree, the routes handling an alert decide its repeat interval.
+func runAlertRepeater(dbClient *sqlx.DB, cfg config.Config, notifier Notifier, held *heldNotifier, logger *log.Logger) {
+	repeatInterval := func(n Notification) time.Duration { return cfg.Hub.RepeatInterval }
+	if r, ok := notifier.(*router); ok {
+		repeatInterval = r.repeatInterval
+	}
+
+	ticker := time.NewTicker(repeatTick(cfg.Hub))
+
+	for range ticker.C {
+		var alerts []Alert
+
+		err := dbClient.Select(&alerts, `
+		select * from alerts a
+		where state = $1 and acknowledged_by = ''
+		and not exists (select 1 from flapping f where f.instance_id = a.instance_id and f.rule = a.rule)
+		`, alertFiring)
+		if err != nil {
+			logger.Printf("Error retrieving alerts to repeat: %s\n", err)
+			continue
+		}
+
+		var notifications []Notification
+		for _, alert := range alerts {
+			event := alertEvent(alert)
+			event.Message = "still firing since " + alert.FiredAt.Format(time.RFC3339) + ": " + event.Message
+			n := newAlertNotification(event, alert)
+
+			// an alert is not repeated before it was first told about
+			if held.holding(n) {
+				continue
+			}
+
+			interval := repeatInterval(n)
+			if interval == 0 || (alert.NotifiedAt != nil && alert.NotifiedAt.After(time.Now().Add(-interval))) {
+				continue
+			}
+
+			notifications = append(notifications, n)
+
+			if _, err := dbClient.Exec("update alerts set notified_at = $1 where id = $2", sqlTime(time.Now()), alert.ID); err != nil {
+				logger.Printf("Error updating alert %d: %s\n", alert.ID, err)
+			}
+		}
+
+		sendNotifications(dbClient, notifier, notifications, logger)
+	}
+}
+
+// repeatTick is how often the repeater looks for alerts to notify about
+// again: every minute, or as often as the shortest repeat interval, but at
+// most once a second.
+func repeatTick(cfg config.Hub) time.Duration {
+	tick := time.Minute
+
+	shorten := func(interval time.Duration) {
+		if interval > 0 && interval < tick {
+			tick = interval
+		}
+	}
+
+	var walk func(r config.Route)
+	walk = func(r config.Route) {
+		shorten(r.RepeatInterval)
+		for _, child := range r.Routes {
+			walk(child)
+		}
+	}
+
+	shorten(cfg.RepeatInterval)
+	walk(cfg.Route)
+
+	if tick < time.Second {
+		tick = time.Second
+	}
+	return tick
+}
+
+func handleGetAlerts(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, logger *log.Logger) {
+	alerts, err := getAlertsFromDB(dbClient, r.URL.Query().Get("state"))
+	if err != nil {
+		logger.Printf("Error retrieving alerts from DB: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alerts)
+}
+
+func getAlertsFromDB(dbClient *sqlx.DB, state string) (alerts []Alert, err error) {
+	err = dbClient.Select(&alerts, `
+	select a.*, exists (
+	  select 1 from flapping f
+	  where f.instance_id = a.instance_id and f.rule = a.rule and f.since <= coalesce(a.resolved_at, current_timestamp)
+	) as flapping
+	from alerts a
+	where $1 = '' or a.state = $1
+	order by a.fired_at desc
+	`, state)
+	return
+}
+
+func writeAlertToDB(dbClient *sqlx.DB, rule config.AlertRule, systemInfo info.Info, value float64, score float64) (int64, error) {
+	ruleType := rule.Type
+	if ruleType == "" {
+		ruleType = ruleTypeThreshold
+	}
+
+	result, err := dbClient.Exec(`
+	insert into alerts (
+	  instance_id,
+	  deployment,
+	  name,
+	  instance_index,
+	  label,
+	  az,
+	  rule,
+	  rule_type,
+	  severity,
+	  stat,
+	  threshold,
+	  value,
+	  score,
+	  state,
+	  notified_at
+	) VALUES (
+	  $1,
+	  $2,
+	  $3,
+	  $4,
+	  $5,
+	  $6,
+	  $7,
+	  $8,
+	  $9,
+	  $10,
+	  $11,
+	  $12,
+	  $13,
+	  $14,
+	  $15
+	  )
+	`,
+		systemInfo.Spec.ID,
+		systemInfo.Spec.Deployment,
+		systemInfo.Spec.InstanceName,
+		systemInfo.Spec.Index,
+		systemInfo.Label,
+		systemInfo.Spec.AZ,
+		rule.Name,
+		ruleType,
+		rule.Severity,
+		rule.Stat,
+		rule.Threshold,
+		value,
+		score,
+		alertFiring,
+		sqlTime(time.Now()),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
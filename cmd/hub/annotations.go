@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"time"
+)
+
+const annotationsSchema = `
+	create table if not exists annotations (
+	  id integer not null primary key,
+	  deployment text not null,
+	  instance_name text not null default '',
+	  instance_id text not null default '',
+	  text text not null,
+	  tags text,
+	  starts_at timestamp not null,
+	  ends_at timestamp not null,
+	  created_at timestamp default current_timestamp not null
+	);
+	`
+
+const eventAnnotation = "annotation"
+
+type Tags []string
+
+func (t *Tags) Scan(src interface{}) error {
+	return scanJSON(src, t)
+}
+
+func (t Tags) Value() (driver.Value, error) {
+	return valueJSON(t)
+}
+
+// Annotation marks a period on the timeline of a deployment, such as a
+// `bosh deploy` recorded by a CI pipeline. InstanceName and InstanceID
+// optionally narrow it down to part of the deployment.
+type Annotation struct {
+	ID           int       `json:"id" db:"id"`
+	Deployment   string    `json:"deployment" db:"deployment"`
+	InstanceName string    `json:"instance_name,omitempty" db:"instance_name"`
+	InstanceID   string    `json:"instance_id,omitempty" db:"instance_id"`
+	Text         string    `json:"text" db:"text"`
+	Tags         Tags      `json:"tags" db:"tags"`
+	StartsAt     time.Time `json:"starts_at" db:"starts_at"`
+	EndsAt       time.Time `json:"ends_at" db:"ends_at"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
+
+func (a Annotation) event() Event {
+	annotation := a
+
+	return Event{
+		InstanceID: a.InstanceID,
+		Deployment: a.Deployment,
+		Name:       a.InstanceName,
+		Kind:       eventAnnotation,
+		Message:    a.Text,
+		CreatedAt:  a.StartsAt,
+		Annotation: &annotation,
+	}
+}
+
+func handleGetAnnotations(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, logger *log.Logger) {
+	var (
+		query = r.URL.Query()
+		from  time.Time
+		to    = time.Now()
+		err   error
+	)
+
+	if s := query.Get("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			logger.Printf("Error parsing from parameter %q: %s\n", s, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if s := query.Get("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			logger.Printf("Error parsing to parameter %q: %s\n", s, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	annotations, err := getAnnotationsFromDB(dbClient, query.Get("deployment"), query.Get("instance_id"), from, to)
+	if err != nil {
+		logger.Printf("Error retrieving annotations from DB: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(annotations)
+}
+
+func handlePostAnnotation(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, logger *log.Logger) {
+	var a Annotation
+
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		logger.Printf("Error reading json body of request: %s\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if a.Deployment == "" || a.Text == "" {
+		logger.Printf("Error annotation is missing a deployment or text\n")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if a.StartsAt.IsZero() {
+		a.StartsAt = time.Now()
+	}
+
+	if a.EndsAt.IsZero() {
+		a.EndsAt = a.StartsAt
+	}
+
+	if a.EndsAt.Before(a.StartsAt) {
+		logger.Printf("Error annotation for %s ends before it starts\n", a.Deployment)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id, err := writeAnnotationToDB(dbClient, a)
+	if err != nil {
+		logger.Printf("Error writing annotation to db for %s: %s\n", a.Deployment, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := dbClient.Get(&a, "select * from annotations where id = $1", id); err != nil {
+		logger.Printf("Error retrieving annotation %d from DB: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// getAnnotationsFromDB returns the annotations overlapping [from, to] that
+// apply to the deployment, or to the given instance within its deployment.
+// An instance the hub never heard of has no annotations.
+func getAnnotationsFromDB(dbClient *sqlx.DB, deployment string, instanceID string, from time.Time, to time.Time) ([]Annotation, error) {
+	var instance struct {
+		Name       string `db:"name"`
+		Deployment string `db:"deployment"`
+	}
+
+	if instanceID != "" {
+		err := dbClient.Get(&instance, "select name, deployment from metrics where instance_id = $1", instanceID)
+
+		// instances removed since are only left in their identity history
+		if err == sql.ErrNoRows {
+			err = dbClient.Get(&instance, "select name, deployment from identity_history where instance_id = $1 order by started_at desc, id desc limit 1", instanceID)
+		}
+		if err == sql.ErrNoRows {
+			return []Annotation{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if deployment == "" {
+			deployment = instance.Deployment
+		}
+	}
+
+	var annotations []Annotation
+
+	err := dbClient.Select(&annotations, `
+	select * from annotations
+	where ($1 = '' or deployment = $1)
+	and ($2 = '' or instance_id = '' or instance_id = $2)
+	and ($3 = '' or instance_name = '' or instance_name = $3)
+	and ends_at >= $4 and starts_at <= $5
+	order by starts_at, id
+	`, deployment, instanceID, instance.Name, sqlTime(from), sqlTime(to))
+
+	return annotations, err
+}
+
+func writeAnnotationToDB(dbClient *sqlx.DB, a Annotation) (int64, error) {
+	result, err := dbClient.Exec(`
+	insert into annotations (
+	  deployment,
+	  instance_name,
+	  instance_id,
+	  text,
+	  tags,
+	  starts_at,
+	  ends_at
+	) VALUES (
+	  $1,
+	  $2,
+	  $3,
+	  $4,
+	  $5,
+	  $6,
+	  $7
+	  )
+	`,
+		a.Deployment,
+		a.InstanceName,
+		a.InstanceID,
+		a.Text,
+		a.Tags,
+		sqlTime(a.StartsAt),
+		sqlTime(a.EndsAt),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
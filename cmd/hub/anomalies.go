@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/aemengo/bosh-deployment-dashboard/config"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+const anomaliesSchema = `
+	create table if not exists anomalies (
+	  instance_id text not null,
+	  stat text not null,
+	  value real not null,
+	  mean real not null,
+	  stddev real not null,
+	  score real not null,
+	  since timestamp default current_timestamp not null,
+	  primary key (instance_id, stat)
+	);
+	`
+
+const (
+	eventAnomaly      = "anomaly"
+	eventAnomalyEnded = "anomaly_ended"
+
+	// fewer points of history than this at an hour of the day make no
+	// baseline
+	minBaselineSamples = 10
+)
+
+var baselineStats = []string{"cpu_used", "memory_used", "load_15"}
+
+// Anomaly is a stat of an instance that is far from its baseline, the
+// usual value of that stat at this hour of the day.
+type Anomaly struct {
+	InstanceID string    `json:"instance_id" db:"instance_id"`
+	Deployment string    `json:"deployment" db:"deployment"`
+	Name       string    `json:"name" db:"name"`
+	Stat       string    `json:"stat" db:"stat"`
+	Value      float64   `json:"value" db:"value"`
+	Mean       float64   `json:"mean" db:"mean"`
+	StdDev     float64   `json:"stddev" db:"stddev"`
+	Score      float64   `json:"score" db:"score"`
+	Since      time.Time `json:"since" db:"since"`
+}
+
+type baseline struct {
+	mean    float64
+	stdDev  float64
+	samples int
+}
+
+// score is how many standard deviations value is above the baseline.
+func (b baseline) score(value float64) float64 {
+	return (value - b.mean) / b.stdDev
+}
+
+func handleGetAnomalies(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, logger *log.Logger) {
+	anomalies := []Anomaly{}
+
+	err := dbClient.Select(&anomalies, `
+	select a.*, m.deployment, m.name from anomalies a
+	join metrics m on m.instance_id = a.instance_id
+	where $1 = '' or m.deployment = $1
+	order by abs(a.score) desc
+	`, r.URL.Query().Get("deployment"))
+	if err != nil {
+		logger.Printf("Error retrieving anomalies from DB: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(anomalies)
+}
+
+// getBaseline works out the mean and standard deviation of the stat of an
+// instance at the current hour of the day on previous days, over the
+// samples within each bucket of history rather than the bucket averages,
+// so that it compares with a single sample. ok is false when there is too
+// little history, or no variation to compare against.
+func getBaseline(dbClient *sqlx.DB, cfg config.Hub, instanceID string, stat string) (baseline, bool, error) {
+	now := time.Now().UTC()
+
+	history, err := getSeriesBuckets(dbClient, cfg.Retention, instanceID, now.Add(-cfg.Baseline.Lookback), now.Add(-time.Hour))
+	if err != nil {
+		return baseline{}, false, err
+	}
+
+	var (
+		b       baseline
+		samples int
+	)
+
+	for _, p := range history {
+		if p.Time.UTC().Hour() != now.Hour() {
+			continue
+		}
+
+		a := p.Stats[stat]
+		b.mean, b.stdDev = pool(b.mean, b.stdDev, samples, a.Avg, a.StdDev, p.Samples)
+		samples += p.Samples
+		b.samples++
+	}
+
+	if b.samples < minBaselineSamples {
+		return baseline{}, false, nil
+	}
+
+	return b, b.stdDev > 0, nil
+}
+
+// detectAnomalies compares the stats of an instance that just reported
+// with their baselines, and returns events for stats that became or
+// stopped being anomalous.
+func detectAnomalies(dbClient *sqlx.DB, cfg config.Hub, metrics Metrics) ([]Event, error) {
+	var events []Event
+
+	for _, stat := range baselineStats {
+		b, ok, err := getBaseline(dbClient, cfg, metrics.InstanceID, stat)
+		if err != nil {
+			return nil, err
+		}
+
+		value, _ := statValue(metrics, stat)
+
+		var existing Anomaly
+		err = dbClient.Get(&existing, "select * from anomalies where instance_id = $1 and stat = $2", metrics.InstanceID, stat)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		anomalous := err == nil
+
+		switch {
+		case ok && math.Abs(b.score(value)) > cfg.Baseline.Sigma:
+			_, err := dbClient.Exec(`
+			insert or replace into anomalies (instance_id, stat, value, mean, stddev, score, since)
+			values ($1, $2, $3, $4, $5, $6, coalesce((select since from anomalies where instance_id = $1 and stat = $2), current_timestamp))
+			`, metrics.InstanceID, stat, value, b.mean, b.stdDev, b.score(value))
+			if err != nil {
+				return nil, err
+			}
+
+			if !anomalous {
+				events = append(events, newMetricsEvent(metrics, eventAnomaly,
+					fmt.Sprintf("%s is %.2f, %.1f sigma from its usual %.2f ± %.2f at this hour", stat, value, b.score(value), b.mean, b.stdDev)))
+			}
+		case anomalous:
+			if _, err := dbClient.Exec("delete from anomalies where instance_id = $1 and stat = $2", metrics.InstanceID, stat); err != nil {
+				return nil, err
+			}
+
+			events = append(events, newMetricsEvent(metrics, eventAnomalyEnded, fmt.Sprintf("%s is back to %.2f", stat, value)))
+		}
+	}
+
+	return events, nil
+}
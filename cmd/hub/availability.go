@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aemengo/bosh-deployment-dashboard/config"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Availability is the share of the observed time an instance, or all
+// instances of a deployment together, spent neither stale, failing nor
+// without a reporting agent.
+// Time before the hub first heard of an instance is not observed.
+type Availability struct {
+	InstanceID    string  `json:"instance_id,omitempty"`
+	Deployment    string  `json:"deployment"`
+	Name          string  `json:"name,omitempty"`
+	InstanceIndex int     `json:"instance_index,omitempty"`
+	Percent       float64 `json:"availability"`
+	Observed      float64 `json:"observed_seconds"`
+	Unavailable   float64 `json:"unavailable_seconds"`
+}
+
+type DeploymentAvailability struct {
+	Availability
+	Instances []Availability `json:"instances"`
+}
+
+type AvailabilityReport struct {
+	From        time.Time                `json:"from"`
+	To          time.Time                `json:"to"`
+	Deployments []DeploymentAvailability `json:"deployments"`
+}
+
+// SLOStatus tells how much of the error budget of an SLO is left, and how
+// fast it burns: a burn rate of 1 uses up exactly the budget over the SLO
+// window.
+type SLOStatus struct {
+	Deployment           string  `json:"deployment"`
+	Target               float64 `json:"target"`
+	Window               string  `json:"window"`
+	Availability         float64 `json:"availability"`
+	ErrorBudgetRemaining float64 `json:"error_budget_remaining"`
+	BurnRate             float64 `json:"burn_rate"`
+	BurnRate1h           float64 `json:"burn_rate_1h"`
+}
+
+func handleGetAvailabilityReport(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, logger *log.Logger) {
+	var (
+		query = r.URL.Query()
+		to    = time.Now().UTC()
+		from  = to.AddDate(0, -1, 0)
+		err   error
+	)
+
+	if s := query.Get("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			logger.Printf("Error parsing from parameter %q: %s\n", s, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if s := query.Get("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			logger.Printf("Error parsing to parameter %q: %s\n", s, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	deployments, err := getAvailability(dbClient, query.Get("deployment"), from, to)
+	if err != nil {
+		logger.Printf("Error computing availability: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if query.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="availability.csv"`)
+		writeAvailabilityCSV(w, deployments)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AvailabilityReport{From: from, To: to, Deployments: deployments})
+}
+
+func handleGetSLOs(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, cfg config.Config, logger *log.Logger) {
+	statuses := []SLOStatus{}
+	now := time.Now().UTC()
+
+	for _, slo := range cfg.Hub.SLOs {
+		window, err := getAvailability(dbClient, slo.Deployment, now.Add(-slo.Window), now)
+		if err != nil {
+			logger.Printf("Error computing availability of %s: %s\n", slo.Deployment, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		lastHour, err := getAvailability(dbClient, slo.Deployment, now.Add(-time.Hour), now)
+		if err != nil {
+			logger.Printf("Error computing availability of %s: %s\n", slo.Deployment, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		status := SLOStatus{
+			Deployment:           slo.Deployment,
+			Target:               slo.Target,
+			Window:               slo.Window.String(),
+			Availability:         100,
+			ErrorBudgetRemaining: 1,
+		}
+
+		// the error budget is the unavailable time the target allows
+		// over the whole window, for every instance of the deployment
+		budget := 1 - slo.Target/100
+
+		if len(window) > 0 {
+			d := window[0]
+			status.Availability = d.Percent
+			status.BurnRate = (1 - d.Percent/100) / budget
+			status.ErrorBudgetRemaining = 1 - d.Unavailable/(budget*float64(len(d.Instances))*slo.Window.Seconds())
+		}
+
+		if len(lastHour) > 0 {
+			status.BurnRate1h = (1 - lastHour[0].Percent/100) / budget
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+func validateSLOs(slos []config.SLO) error {
+	for _, slo := range slos {
+		if slo.Deployment == "" {
+			return errors.New("slo is missing a deployment")
+		}
+
+		if slo.Target <= 0 || slo.Target >= 100 {
+			return fmt.Errorf("slo target for %s must be a percentage between 0 and 100", slo.Deployment)
+		}
+	}
+	return nil
+}
+
+// getAvailability replays the status history of every instance, or of the
+// instances of one deployment, over [from, to]. Instances the director
+// expects but whose agent does not report count as unavailable. Instances
+// removed since still count for the time they were around.
+func getAvailability(dbClient *sqlx.DB, deployment string, from time.Time, to time.Time) ([]DeploymentAvailability, error) {
+	if now := time.Now().UTC(); to.After(now) {
+		to = now
+	}
+
+	var transitions []struct {
+		InstanceID string    `db:"instance_id"`
+		Status     string    `db:"status"`
+		StartedAt  time.Time `db:"started_at"`
+	}
+
+	// the transitions within the period, along with the last one before
+	// it, which holds the status the period starts with
+	err := dbClient.Select(&transitions, `
+	select instance_id, status, started_at from status_history
+	where (started_at >= $1 or id = (
+	  select h.id from status_history h
+	  where h.instance_id = status_history.instance_id and h.started_at < $1
+	  order by h.started_at desc, h.id desc limit 1
+	))
+	and started_at < $2
+	order by instance_id, started_at, id
+	`, sqlTime(from), sqlTime(to))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		observed    = map[string]float64{}
+		unavailable = map[string]float64{}
+	)
+
+	for i, t := range transitions {
+		start := t.StartedAt
+		end := to
+		if i+1 < len(transitions) && transitions[i+1].InstanceID == t.InstanceID {
+			end = transitions[i+1].StartedAt
+		}
+
+		if start.Before(from) {
+			start = from
+		}
+
+		if t.Status == statusRemoved || !end.After(start) {
+			continue
+		}
+
+		seconds := end.Sub(start).Seconds()
+		observed[t.InstanceID] += seconds
+
+		if t.Status == statusStale || t.Status == statusFailing || t.Status == missingAgent {
+			unavailable[t.InstanceID] += seconds
+		}
+	}
+
+	instances, err := getAvailabilityInstances(dbClient, observed)
+	if err != nil {
+		return nil, err
+	}
+
+	var metrics []Metrics
+	for _, m := range instances {
+		if deployment == "" || m.Deployment == deployment {
+			metrics = append(metrics, m)
+		}
+	}
+
+	var (
+		deployments []DeploymentAvailability
+		index       = map[string]int{}
+	)
+
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].Deployment != metrics[j].Deployment {
+			return metrics[i].Deployment < metrics[j].Deployment
+		}
+		if metrics[i].Name != metrics[j].Name {
+			return metrics[i].Name < metrics[j].Name
+		}
+		return metrics[i].InstanceIndex < metrics[j].InstanceIndex
+	})
+
+	for _, m := range metrics {
+		i, ok := index[m.Deployment]
+		if !ok {
+			i = len(deployments)
+			index[m.Deployment] = i
+			deployments = append(deployments, DeploymentAvailability{Availability: Availability{Deployment: m.Deployment}})
+		}
+
+		d := &deployments[i]
+		d.Observed += observed[m.InstanceID]
+		d.Unavailable += unavailable[m.InstanceID]
+
+		d.Instances = append(d.Instances, Availability{
+			InstanceID:    m.InstanceID,
+			Deployment:    m.Deployment,
+			Name:          m.Name,
+			InstanceIndex: m.InstanceIndex,
+			Percent:       availabilityPercent(observed[m.InstanceID], unavailable[m.InstanceID]),
+			Observed:      observed[m.InstanceID],
+			Unavailable:   unavailable[m.InstanceID],
+		})
+	}
+
+	for i := range deployments {
+		deployments[i].Percent = availabilityPercent(deployments[i].Observed, deployments[i].Unavailable)
+	}
+
+	return deployments, nil
+}
+
+// getAvailabilityInstances returns the instances availability is reported
+// for, keyed by instance ID: the ones the hub knows of now, whether they
+// report or the director misses their agent, and those observed in the
+// period that were removed since, as they were last seen.
+func getAvailabilityInstances(dbClient *sqlx.DB, observed map[string]float64) (map[string]Metrics, error) {
+	instances := map[string]Metrics{}
+
+	var identities []identity
+	err := dbClient.Select(&identities, `
+	select instance_id, name, address, az, deployment, instance_index, ip, label, source, started_at from identity_history
+	where id in (select max(id) from identity_history group by instance_id)
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range identities {
+		if observed[i.InstanceID] > 0 {
+			instances[i.InstanceID] = i.metrics()
+		}
+	}
+
+	var missing []Discrepancy
+	if err := dbClient.Select(&missing, "select * from reconciliation where state = $1", missingAgent); err != nil {
+		return nil, err
+	}
+
+	for _, d := range missing {
+		instances[d.InstanceID] = d.metrics()
+	}
+
+	var metrics []Metrics
+	if err := dbClient.Select(&metrics, "select * from metrics"); err != nil {
+		return nil, err
+	}
+
+	for _, m := range metrics {
+		instances[m.InstanceID] = m
+	}
+
+	return instances, nil
+}
+
+func availabilityPercent(observed float64, unavailable float64) float64 {
+	if observed == 0 {
+		return 100
+	}
+
+	return 100 * (observed - unavailable) / observed
+}
+
+func writeAvailabilityCSV(w http.ResponseWriter, deployments []DeploymentAvailability) {
+	writer := csv.NewWriter(w)
+
+	writer.Write([]string{
+		"deployment",
+		"instance_group",
+		"instance_index",
+		"instance_id",
+		"availability",
+		"observed_seconds",
+		"unavailable_seconds",
+	})
+
+	row := func(a Availability, index string) []string {
+		return []string{
+			a.Deployment,
+			a.Name,
+			index,
+			a.InstanceID,
+			strconv.FormatFloat(a.Percent, 'f', 3, 64),
+			strconv.FormatFloat(a.Observed, 'f', 0, 64),
+			strconv.FormatFloat(a.Unavailable, 'f', 0, 64),
+		}
+	}
+
+	for _, d := range deployments {
+		writer.Write(row(d.Availability, ""))
+
+		for _, instance := range d.Instances {
+			writer.Write(row(instance, strconv.Itoa(instance.InstanceIndex)))
+		}
+	}
+
+	writer.Flush()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+// sqlTimeFormat matches how sqlite's current_timestamp renders, so that
+// timestamps passed as parameters compare correctly with stored ones.
+const sqlTimeFormat = "2006-01-02 15:04:05"
+
+// scanJSON decodes a text column holding JSON into v. It backs the
+// sql.Scanner implementations of the hub's JSON encoded columns.
+func scanJSON(src interface{}, v interface{}) error {
+	switch s := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(s, v)
+	case string:
+		return json.Unmarshal([]byte(s), v)
+	default:
+		return fmt.Errorf("unable to scan %T into json column", src)
+	}
+}
+
+func valueJSON(v interface{}) (string, error) {
+	contents, err := json.Marshal(v)
+	return string(contents), err
+}
+
+func sqlTime(t time.Time) string {
+	return t.UTC().Format(sqlTimeFormat)
+}
+
+// addColumn adds a column to a table created by an earlier version of the
+// hub, leaving tables that already have it untouched.
+func addColumn(dbClient *sqlx.DB, table string, column string, definition string) error {
+	var count int
+
+	err := dbClient.Get(&count, "select count(*) from pragma_table_info($1) where name = $2", table, column)
+	if err != nil || count > 0 {
+		return err
+	}
+
+	_, err = dbClient.Exec(fmt.Sprintf("alter table %s add column %s %s", table, column, definition))
+	return err
+}
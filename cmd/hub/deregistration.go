@@ -0,0 +1,143 @@
+package main
+
+import (
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const eventRemoved = "removed"
+
+func handleDeleteHealth(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, logger *log.Logger) {
+	instanceID := strings.TrimPrefix(r.URL.Path, "/api/health/")
+
+	var metrics []Metrics
+	if err := dbClient.Select(&metrics, "select * from metrics where instance_id = $1", instanceID); err != nil {
+		logger.Printf("Error retrieving %s from DB: %s\n", instanceID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(metrics) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := removeInstances(dbClient, metrics, "deregistered", logger); err != nil {
+		logger.Printf("Error removing %s: %s\n", instanceID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
+}
+
+func handleDeleteDeployment(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, logger *log.Logger) {
+	deployment := strings.TrimPrefix(r.URL.Path, "/api/deployments/")
+
+	var metrics []Metrics
+	if err := dbClient.Select(&metrics, "select * from metrics where deployment = $1", deployment); err != nil {
+		logger.Printf("Error retrieving instances of %s from DB: %s\n", deployment, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(metrics) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := removeInstances(dbClient, metrics, "deployment deleted", logger); err != nil {
+		logger.Printf("Error removing instances of %s: %s\n", deployment, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := dbClient.Exec("delete from quorum_status where deployment = $1", deployment); err != nil {
+		logger.Printf("Error removing quorum status of %s: %s\n", deployment, err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
+}
+
+// pruneMissingInstances removes instances that have not reported within
+// pruneAfter.
+func pruneMissingInstances(dbClient *sqlx.DB, pruneAfter time.Duration, logger *log.Logger) error {
+	var metrics []Metrics
+
+	err := dbClient.Select(&metrics, "select * from metrics where updated_at < $1", sqlTime(time.Now().Add(-pruneAfter)))
+	if err != nil || len(metrics) == 0 {
+		return err
+	}
+
+	return removeInstances(dbClient, metrics, "missing for more than "+pruneAfter.String(), logger)
+}
+
+// removeInstances drops the instances from the live views of the hub and
+// records a removed event for each. The status history of an instance ends
+// with removed and its firing alerts are resolved without notice. Its history
+// and events are kept for reports.
+func removeInstances(dbClient *sqlx.DB, metrics []Metrics, reason string, logger *log.Logger) error {
+	var events []Event
+
+	for _, m := range metrics {
+		if err := removeInstance(dbClient, m); err != nil {
+			writeEvents(dbClient, events, logger)
+			return err
+		}
+
+		events = append(events, newMetricsEvent(m, eventRemoved, reason))
+	}
+
+	writeEvents(dbClient, events, logger)
+	return nil
+}
+
+// removeInstance removes a single instance in one transaction, so that a
+// failure leaves it wholly in place.
+func removeInstance(dbClient *sqlx.DB, m Metrics) error {
+	tx, err := dbClient.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		"delete from metrics where instance_id = $1",
+		"delete from instance_status where instance_id = $1",
+		"delete from inventory where instance_id = $1",
+		"delete from flapping where instance_id = $1",
+		"delete from anomalies where instance_id = $1",
+		"delete from disk_forecasts where instance_id = $1",
+		"delete from reconciliation where instance_id = $1",
+		"delete from instance_changes where instance_id = $1",
+		"insert or replace into removed_instances (instance_id) values ($1)",
+		"insert into status_history (instance_id, status) values ($1, '" + statusRemoved + "')",
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, m.InstanceID); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("update alerts set state = $1, resolved_at = current_timestamp where instance_id = $2 and state = $3", alertResolved, m.InstanceID, alertFiring)
+	if err != nil {
+		return err
+	}
+
+	// the drift of the rest of the instance group is taken without it
+	_, err = tx.Exec(`
+	insert or replace into instance_changes (instance_id)
+	select instance_id from metrics where deployment = $1 and name = $2
+	`, m.Deployment, m.Name)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aemengo/bosh-deployment-dashboard/config"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// directorTaskTimeout bounds how long runTask waits for a director task.
+const directorTaskTimeout = 5 * time.Minute
+
+// errTaskRunning is returned by runTask while the task it gave up waiting
+// for last time is still running on the director.
+var errTaskRunning = errors.New("the previous director task is still running")
+
+// DirectorInstance is an instance of a deployment as the BOSH Director
+// lists it.
+type DirectorInstance struct {
+	ID         string `json:"id"`
+	AgentID    string `json:"agent_id"`
+	CID        string `json:"cid"`
+	Job        string `json:"job"`
+	Index      int    `json:"index"`
+	AZ         string `json:"az"`
+	ExpectsVM  bool   `json:"expects_vm"`
+	Deployment string `json:"-"`
+}
+
+// directorClient talks to the BOSH Director API, fetching a UAA token
+// with the client credentials whenever the last one ran out.
+type directorClient struct {
+	cfg        config.Director
+	httpClient *http.Client
+	token      string
+	expiresAt  time.Time
+
+	// running holds the task runTask gave up waiting for, by the path
+	// that started it
+	running map[string]string
+}
+
+func validateDirector(cfg config.Director) error {
+	if cfg.URL == "" {
+		if len(cfg.Agentless) > 0 {
+			return errors.New("agentless deployments need a director url")
+		}
+		return nil
+	}
+
+	if cfg.ClientID == "" || cfg.ClientSecret == "" {
+		return errors.New("director is missing a client_id or client_secret")
+	}
+
+	return nil
+}
+
+func newDirectorClient(cfg config.Director) (*directorClient, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if cfg.CACert != "" && !pool.AppendCertsFromPEM([]byte(cfg.CACert)) {
+		return nil, errors.New("director ca_cert holds no PEM encoded certificates")
+	}
+
+	return &directorClient{
+		cfg:     cfg,
+		running: map[string]string{},
+		httpClient: &http.Client{
+			Timeout:   time.Minute,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+
+			// the director answers requests that start a task with a
+			// redirect to the task, which runTask follows itself
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}, nil
+}
+
+func (c *directorClient) authenticate() error {
+	if c.token != "" && time.Now().Before(c.expiresAt) {
+		return nil
+	}
+
+	var info struct {
+		UserAuthentication struct {
+			Options struct {
+				URL string `json:"url"`
+			} `json:"options"`
+		} `json:"user_authentication"`
+	}
+
+	if err := c.do(http.MethodGet, strings.TrimSuffix(c.cfg.URL, "/")+"/info", &info); err != nil {
+		return err
+	}
+
+	uaaURL := info.UserAuthentication.Options.URL
+	if uaaURL == "" {
+		return errors.New("director does not authenticate with UAA")
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+
+	request, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(uaaURL, "/")+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.SetBasicAuth(c.cfg.ClientID, c.cfg.ClientSecret)
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+
+	if err := c.send(request, &token); err != nil {
+		return fmt.Errorf("fetching UAA token: %s", err)
+	}
+
+	// renew a little early, so that no request goes out with a token
+	// that expires on the way
+	c.token = token.AccessToken
+	c.expiresAt = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - 30*time.Second)
+	return nil
+}
+
+// get decodes the response of the director to an authenticated GET.
+func (c *directorClient) get(path string, v interface{}) error {
+	if err := c.authenticate(); err != nil {
+		return err
+	}
+
+	return c.do(http.MethodGet, strings.TrimSuffix(c.cfg.URL, "/")+path, v)
+}
+
+func (c *directorClient) do(method string, target string, v interface{}) error {
+	request, err := c.newRequest(method, target)
+	if err != nil {
+		return err
+	}
+
+	return c.send(request, v)
+}
+
+func (c *directorClient) newRequest(method string, target string) (*http.Request, error) {
+	request, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	return request, nil
+}
+
+func (c *directorClient) send(request *http.Request, v interface{}) error {
+	contents, err := c.read(request)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(contents, v)
+}
+
+func (c *directorClient) read(request *http.Request) ([]byte, error) {
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", request.Method, request.URL.Path, response.Status)
+	}
+
+	return ioutil.ReadAll(response.Body)
+}
+
+// runTask starts the director task behind a GET of path, waits for it to
+// finish and returns its result. It starts no other task for path while
+// one it gave up waiting for is still running.
+func (c *directorClient) runTask(path string) ([]byte, error) {
+	if err := c.authenticate(); err != nil {
+		return nil, err
+	}
+
+	if taskPath, ok := c.running[path]; ok {
+		var task struct {
+			State string `json:"state"`
+		}
+
+		if err := c.get(taskPath, &task); err != nil {
+			return nil, err
+		}
+
+		if task.State == "queued" || task.State == "processing" {
+			return nil, errTaskRunning
+		}
+
+		delete(c.running, path)
+	}
+
+	request, err := c.newRequest(http.MethodGet, strings.TrimSuffix(c.cfg.URL, "/")+path)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusFound {
+		return nil, fmt.Errorf("%s %s: %s", request.Method, request.URL.Path, response.Status)
+	}
+
+	taskURL, err := response.Location()
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(directorTaskTimeout)
+
+	for {
+		var task struct {
+			State  string `json:"state"`
+			Result string `json:"result"`
+		}
+
+		if err := c.get(taskURL.Path, &task); err != nil {
+			return nil, err
+		}
+
+		if task.State == "done" {
+			break
+		}
+
+		if task.State != "queued" && task.State != "processing" {
+			return nil, fmt.Errorf("director task %s is %s: %s", taskURL.Path, task.State, task.Result)
+		}
+
+		if time.Now().After(deadline) {
+			c.running[path] = taskURL.Path
+			return nil, fmt.Errorf("director task %s did not finish within %s", taskURL.Path, directorTaskTimeout)
+		}
+
+		time.Sleep(time.Second)
+	}
+
+	request, err = c.newRequest(http.MethodGet, strings.TrimSuffix(c.cfg.URL, "/")+taskURL.Path+"/output?type=result")
+	if err != nil {
+		return nil, err
+	}
+
+	return c.read(request)
+}
+
+// getInstances lists the instances of every deployment on the director.
+func (c *directorClient) getInstances() ([]DirectorInstance, error) {
+	var deployments []struct {
+		Name string `json:"name"`
+	}
+
+	if err := c.get("/deployments", &deployments); err != nil {
+		return nil, err
+	}
+
+	var instances []DirectorInstance
+
+	for _, d := range deployments {
+		var deploymentInstances []DirectorInstance
+		if err := c.get("/deployments/"+url.PathEscape(d.Name)+"/instances", &deploymentInstances); err != nil {
+			return nil, err
+		}
+
+		for _, i := range deploymentInstances {
+			i.Deployment = d.Name
+			instances = append(instances, i)
+		}
+	}
+
+	return instances, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/aemengo/bosh-deployment-dashboard/info"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const versionsSchema = `
+	create table if not exists instance_versions (
+	  instance_id text not null,
+	  kind text not null,
+	  name text not null,
+	  version text,
+	  primary key (instance_id, kind, name)
+	);
+	`
+
+const (
+	versionKindStemcell = "stemcell"
+	versionKindJob      = "job"
+	versionKindPackage  = "package"
+	versionKindConfig   = "config"
+)
+
+type instanceVersion struct {
+	InstanceID    string `db:"instance_id"`
+	Deployment    string `db:"deployment"`
+	InstanceName  string `db:"instance_name"`
+	InstanceIndex int    `db:"instance_index"`
+	Kind          string `db:"kind"`
+	Name          string `db:"name"`
+	Version       string `db:"version"`
+}
+
+type DriftedInstance struct {
+	InstanceID    string `json:"instance_id"`
+	InstanceIndex int    `json:"instance_index"`
+	Version       string `json:"version"`
+}
+
+type Drift struct {
+	Deployment      string            `json:"deployment"`
+	InstanceName    string            `json:"instance_name"`
+	Kind            string            `json:"kind"`
+	Name            string            `json:"name"`
+	ExpectedVersion string            `json:"expected_version"`
+	Instances       []DriftedInstance `json:"instances"`
+}
+
+func (d Drift) component() string {
+	return d.Kind + "/" + d.Name
+}
+
+func handleGetDrift(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, logger *log.Logger) {
+	drift, err := getVersionDrift(dbClient, r.URL.Query().Get("deployment"), r.URL.Query().Get("kind"))
+	if err != nil {
+		logger.Printf("Error computing version drift: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(drift)
+}
+
+// getVersionDrift compares the stemcell, job and package versions and the
+// job configuration hashes of every instance with the other instances of its
+// instance group and reports the instances that deviate from the majority.
+func getVersionDrift(dbClient *sqlx.DB, deployment string, kind string) ([]Drift, error) {
+	var versions []instanceVersion
+
+	err := dbClient.Select(&versions, `
+	select
+	  v.instance_id,
+	  i.deployment,
+	  i.name as instance_name,
+	  i.instance_index,
+	  v.kind,
+	  v.name,
+	  v.version
+	from instance_versions v
+	join inventory i on i.instance_id = v.instance_id
+	where ($1 = '' or i.deployment = $1)
+	and ($2 = '' or v.kind = $2)
+	order by i.deployment, i.name, i.instance_index
+	`, deployment, kind)
+	if err != nil {
+		return nil, err
+	}
+
+	type groupKey struct{ deployment, instanceName string }
+
+	var (
+		groupOrder []groupKey
+		instances  = map[groupKey][]instanceVersion{}
+		components = map[groupKey]map[string]map[string]string{}
+	)
+
+	for _, v := range versions {
+		key := groupKey{v.Deployment, v.InstanceName}
+		if _, ok := components[key]; !ok {
+			groupOrder = append(groupOrder, key)
+			components[key] = map[string]map[string]string{}
+		}
+
+		component := v.Kind + "/" + v.Name
+		if _, ok := components[key][component]; !ok {
+			components[key][component] = map[string]string{}
+		}
+		components[key][component][v.InstanceID] = v.Version
+
+		if !containsInstance(instances[key], v.InstanceID) {
+			instances[key] = append(instances[key], v)
+		}
+	}
+
+	drift := []Drift{}
+
+	for _, key := range groupOrder {
+		var componentNames []string
+		for component := range components[key] {
+			componentNames = append(componentNames, component)
+		}
+		sort.Strings(componentNames)
+
+		for _, component := range componentNames {
+			byInstance := components[key][component]
+
+			// an instance without the component at all counts as drift too
+			var values []string
+			for _, instance := range instances[key] {
+				values = append(values, byInstance[instance.InstanceID])
+			}
+			// without a clear majority no instance is the odd one out
+			expected, ok := majority(values)
+			if !ok {
+				continue
+			}
+
+			parts := strings.SplitN(component, "/", 2)
+			d := Drift{
+				Deployment:      key.deployment,
+				InstanceName:    key.instanceName,
+				Kind:            parts[0],
+				Name:            parts[1],
+				ExpectedVersion: expected,
+			}
+
+			for _, instance := range instances[key] {
+				if version := byInstance[instance.InstanceID]; version != expected {
+					d.Instances = append(d.Instances, DriftedInstance{
+						InstanceID:    instance.InstanceID,
+						InstanceIndex: instance.InstanceIndex,
+						Version:       version,
+					})
+				}
+			}
+
+			if len(d.Instances) > 0 {
+				drift = append(drift, d)
+			}
+		}
+	}
+
+	return drift, nil
+}
+
+// getDriftDetails summarizes drift per instance id, for flagging instances
+// in the health response.
+func getDriftDetails(dbClient *sqlx.DB) (map[string][]string, error) {
+	drift, err := getVersionDrift(dbClient, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	details := map[string][]string{}
+	for _, d := range drift {
+		for _, instance := range d.Instances {
+			details[instance.InstanceID] = append(details[instance.InstanceID], d.component())
+		}
+	}
+
+	return details, nil
+}
+
+// majority returns the most common value, and false when several values
+// are the most common.
+func majority(values []string) (string, bool) {
+	counts := map[string]int{}
+	for _, value := range values {
+		counts[value]++
+	}
+
+	var (
+		result string
+		best   int
+		tied   bool
+	)
+	for value, count := range counts {
+		switch {
+		case count > best:
+			result, best, tied = value, count, false
+		case count == best:
+			tied = true
+		}
+	}
+
+	return result, !tied
+}
+
+func containsInstance(versions []instanceVersion, instanceID string) bool {
+	for _, v := range versions {
+		if v.InstanceID == instanceID {
+			return true
+		}
+	}
+	return false
+}
+
+// writeVersionsToDB replaces the versions of an instance. When they
+// changed, the drift of every instance in its instance group may have too.
+func writeVersionsToDB(tx *sqlx.Tx, inventoryInfo info.InventoryInfo) error {
+	var previous []instanceVersion
+	if err := tx.Select(&previous, "select instance_id, kind, name, version from instance_versions where instance_id = $1", inventoryInfo.Spec.ID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("delete from instance_versions where instance_id = $1", inventoryInfo.Spec.ID); err != nil {
+		return err
+	}
+
+	versions := map[string]map[string]string{
+		versionKindStemcell: {versionKindStemcell: inventoryInfo.Inventory.StemcellVersion},
+		versionKindJob:      inventoryInfo.Inventory.Jobs,
+		versionKindPackage:  inventoryInfo.Inventory.Packages,
+		versionKindConfig:   inventoryInfo.Inventory.ConfigHashes,
+	}
+
+	changed := false
+	count := 0
+
+	for _, v := range previous {
+		if version, ok := versions[v.Kind][v.Name]; !ok || version != v.Version {
+			changed = true
+		}
+	}
+
+	for kind, byName := range versions {
+		for name, version := range byName {
+			count++
+			_, err := tx.Exec(
+				"insert into instance_versions (instance_id, kind, name, version) values ($1, $2, $3, $4)",
+				inventoryInfo.Spec.ID, kind, name, version,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if !changed && count == len(previous) {
+		return nil
+	}
+
+	_, err := tx.Exec(`
+	insert or replace into instance_changes (instance_id)
+	select instance_id from metrics where deployment = $1 and name = $2
+	`, inventoryInfo.Spec.Deployment, inventoryInfo.Spec.InstanceName)
+	return err
+}
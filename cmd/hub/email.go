@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/aemengo/bosh-deployment-dashboard/config"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const digestTimeFormat = "15:04"
+
+// smtpTimeout bounds connecting to the mail server and every exchange
+// with it after that.
+const smtpTimeout = 30 * time.Second
+
+// emailNotifier sends notifications over SMTP.
+type emailNotifier struct {
+	cfg config.Email
+}
+
+// Notify sends one email for the notifications, addressed by the first of
+// them, listing each one in the body.
+func (e emailNotifier) Notify(notifications []Notification) error {
+	if len(notifications) == 0 {
+		return nil
+	}
+
+	first := notifications[0]
+	subject := "[bdd] " + first.Kind
+	if about := notificationSubject(first); about != "" {
+		subject += ": " + about
+	}
+	if len(notifications) > 1 {
+		subject = fmt.Sprintf("[bdd] %d notifications: %s", len(notifications), first.Deployment)
+	}
+
+	var body bytes.Buffer
+	for i, n := range notifications {
+		if i > 0 {
+			fmt.Fprintf(&body, "\n----\n\n")
+		}
+
+		fmt.Fprintf(&body, "%s\n\n", n.Message)
+		fmt.Fprintf(&body, "deployment: %s\n", n.Deployment)
+		if n.InstanceID != "" {
+			fmt.Fprintf(&body, "instance:   %s/%d (%s)\n", n.Name, n.InstanceIndex, n.InstanceID)
+			fmt.Fprintf(&body, "label:      %s\n", n.Label)
+			fmt.Fprintf(&body, "az:         %s\n", n.AZ)
+		} else if n.Name != "" {
+			fmt.Fprintf(&body, "group:      %s\n", n.Name)
+		}
+		if n.Rule != "" {
+			fmt.Fprintf(&body, "rule:       %s (%s)\n", n.Rule, n.Severity)
+		}
+		fmt.Fprintf(&body, "time:       %s\n", n.CreatedAt.Format(time.RFC1123Z))
+	}
+
+	return e.send(e.recipients(first.Deployment, first.Label), subject, body.String())
+}
+
+// notificationSubject names what a notification is about: an instance, or
+// the instance group or deployment of notifications not about one, such as
+// quorums and incidents.
+func notificationSubject(n Notification) string {
+	switch {
+	case n.InstanceID != "":
+		return fmt.Sprintf("%s/%s/%d", n.Deployment, n.Name, n.InstanceIndex)
+	case n.Name != "":
+		return n.Deployment + "/" + n.Name
+	default:
+		return n.Deployment
+	}
+}
+
+// recipients returns the recipients of the first route matching the
+// deployment and label, or the default recipients.
+func (e emailNotifier) recipients(deployment string, label string) []string {
+	for _, route := range e.cfg.Routes {
+		if (route.Deployment == "" || route.Deployment == deployment) && (route.Label == "" || route.Label == label) {
+			return route.To
+		}
+	}
+
+	return e.cfg.To
+}
+
+func (e emailNotifier) send(to []string, subject string, body string) error {
+	if len(to) == 0 {
+		return errors.New("no email recipients configured")
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(e.cfg.Host, e.cfg.Port), smtpTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	c, err := smtp.NewClient(conn, e.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if e.cfg.StartTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: e.cfg.Host}); err != nil {
+			return err
+		}
+	}
+
+	if e.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", e.cfg.Username, e.cfg.Password, e.cfg.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(e.cfg.From); err != nil {
+		return err
+	}
+
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "From: %s\r\n", e.cfg.From)
+	fmt.Fprintf(w, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(w, "Subject: %s\r\n", headerValue(subject))
+	fmt.Fprintf(w, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(w, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprint(w, strings.Replace(body, "\n", "\r\n", -1))
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// headerValue keeps names reported by agents, which end up in subjects,
+// from breaking out of their header line.
+func headerValue(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+func validateEmail(cfg config.Email) error {
+	if cfg.Host == "" {
+		return nil
+	}
+
+	if cfg.From == "" {
+		return errors.New("email notifier is missing a from address")
+	}
+
+	if cfg.DigestAt != "" {
+		if _, err := time.Parse(digestTimeFormat, cfg.DigestAt); err != nil {
+			return fmt.Errorf("email digest_at %q is not a time of day like 08:00", cfg.DigestAt)
+		}
+	}
+
+	return nil
+}
+
+// runEmailDigest sends the fleet status of every deployment once a day at
+// the configured time of day.
+func runEmailDigest(dbClient *sqlx.DB, cfg config.Config, logger *log.Logger) {
+	if cfg.Hub.Email.Host == "" || cfg.Hub.Email.DigestAt == "" {
+		return
+	}
+
+	at, _ := time.Parse(digestTimeFormat, cfg.Hub.Email.DigestAt)
+	notifier := emailNotifier{cfg: cfg.Hub.Email}
+
+	for {
+		now := time.Now()
+		next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+
+		time.Sleep(next.Sub(now))
+
+		digests, err := buildDigests(dbClient)
+		if err != nil {
+			logger.Printf("Error building email digest: %s\n", err)
+			continue
+		}
+
+		for deployment, d := range digests {
+			subject := fmt.Sprintf("[bdd] daily digest: %s", deployment)
+			if err := notifier.send(notifier.digestRecipients(deployment, d.labels), subject, d.body); err != nil {
+				logger.Printf("Error sending email digest for %s: %s\n", deployment, err)
+			}
+		}
+	}
+}
+
+// digest is the daily status of a deployment, along with the labels of its
+// instances that routes may address it by.
+type digest struct {
+	labels []string
+	body   string
+}
+
+// digestRecipients collects the recipients of the routes of every label in
+// a deployment, as its digest covers the instances of all of them.
+func (e emailNotifier) digestRecipients(deployment string, labels []string) []string {
+	var (
+		to   []string
+		seen = map[string]bool{}
+	)
+
+	for _, label := range labels {
+		for _, rcpt := range e.recipients(deployment, label) {
+			if !seen[rcpt] {
+				seen[rcpt] = true
+				to = append(to, rcpt)
+			}
+		}
+	}
+
+	return to
+}
+
+// buildDigests summarizes the status of every deployment, keyed by name.
+func buildDigests(dbClient *sqlx.DB) (map[string]digest, error) {
+	metrics, err := getMetricsFromDB(dbClient)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses, err := getStatusesFromDB(dbClient)
+	if err != nil {
+		return nil, err
+	}
+
+	alerts, err := getAlertsFromDB(dbClient, alertFiring)
+	if err != nil {
+		return nil, err
+	}
+
+	byDeployment := map[string][]Metrics{}
+	for _, m := range metrics {
+		byDeployment[m.Deployment] = append(byDeployment[m.Deployment], m)
+	}
+
+	digests := map[string]digest{}
+
+	for deployment, instances := range byDeployment {
+		sort.Slice(instances, func(i, j int) bool {
+			if instances[i].Name != instances[j].Name {
+				return instances[i].Name < instances[j].Name
+			}
+			return instances[i].InstanceIndex < instances[j].InstanceIndex
+		})
+
+		var (
+			counts = map[string]int{}
+			labels = map[string]bool{}
+			d      digest
+			body   bytes.Buffer
+		)
+
+		for _, m := range instances {
+			counts[statuses[m.InstanceID]]++
+
+			if !labels[m.Label] {
+				labels[m.Label] = true
+				d.labels = append(d.labels, m.Label)
+			}
+		}
+
+		fmt.Fprintf(&body, "%s: %d instance(s), %d healthy, %d failing, %d stale\n\n",
+			deployment, len(instances), counts[statusHealthy], counts[statusFailing], counts[statusStale])
+
+		for _, m := range instances {
+			if status := statuses[m.InstanceID]; status == statusFailing || status == statusStale {
+				fmt.Fprintf(&body, "  %s/%d (%s): %s\n", m.Name, m.InstanceIndex, m.InstanceID, status)
+			}
+		}
+
+		var firing []string
+		for _, a := range alerts {
+			if a.Deployment == deployment {
+				line := fmt.Sprintf("  %s on %s/%d since %s", a.Rule, a.Name, a.InstanceIndex, a.FiredAt.Format(time.RFC1123Z))
+				if a.AcknowledgedBy != "" {
+					line += ", acknowledged by " + a.AcknowledgedBy
+				}
+				firing = append(firing, line)
+			}
+		}
+
+		if len(firing) > 0 {
+			fmt.Fprintf(&body, "\nfiring alerts:\n%s\n", strings.Join(firing, "\n"))
+		}
+
+		d.body = body.String()
+		digests[deployment] = d
+	}
+
+	return digests, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/aemengo/bosh-deployment-dashboard/info"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const eventsSchema = `
+	create table if not exists events (
+	  id integer not null primary key,
+	  instance_id text,
+	  deployment text,
+	  name text,
+	  instance_index integer,
+	  kind text,
+	  message text,
+	  created_at timestamp default current_timestamp not null
+	);
+	`
+
+const (
+	eventFirstSeen       = "first_seen"
+	eventWentStale       = "went_stale"
+	eventCameBack        = "came_back"
+	eventRebooted        = "rebooted"
+	eventRecreated       = "recreated"
+	eventMoved           = "moved"
+	eventIndexReassigned = "index_reassigned"
+	eventStatusChanged   = "status_changed"
+	eventAlertFired      = "alert_fired"
+	eventAlertResolved   = "alert_resolved"
+)
+
+type Event struct {
+	ID            int         `json:"id" db:"id"`
+	InstanceID    string      `json:"instance_id" db:"instance_id"`
+	Deployment    string      `json:"deployment" db:"deployment"`
+	Name          string      `json:"name" db:"name"`
+	InstanceIndex int         `json:"instance_index" db:"instance_index"`
+	Kind          string      `json:"kind" db:"kind"`
+	Message       string      `json:"message" db:"message"`
+	CreatedAt     time.Time   `json:"created_at" db:"created_at"`
+	Annotation    *Annotation `json:"annotation,omitempty" db:"-"`
+}
+
+func newEvent(systemInfo info.Info, kind string, message string) Event {
+	return Event{
+		InstanceID:    systemInfo.Spec.ID,
+		Deployment:    systemInfo.Spec.Deployment,
+		Name:          systemInfo.Spec.InstanceName,
+		InstanceIndex: systemInfo.Spec.Index,
+		Kind:          kind,
+		Message:       message,
+	}
+}
+
+func newMetricsEvent(metrics Metrics, kind string, message string) Event {
+	return Event{
+		InstanceID:    metrics.InstanceID,
+		Deployment:    metrics.Deployment,
+		Name:          metrics.Name,
+		InstanceIndex: metrics.InstanceIndex,
+		Kind:          kind,
+		Message:       message,
+	}
+}
+
+func handleGetEvents(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, logger *log.Logger) {
+	var since time.Time
+
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			logger.Printf("Error parsing since parameter %q: %s\n", s, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	deployment, instanceID := r.URL.Query().Get("deployment"), r.URL.Query().Get("instance_id")
+
+	events, err := getEventsFromDB(dbClient, deployment, instanceID, since)
+	if err != nil {
+		logger.Printf("Error retrieving events from DB: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	annotations, err := getAnnotationsFromDB(dbClient, deployment, instanceID, since, time.Now())
+	if err != nil {
+		logger.Printf("Error retrieving annotations from DB: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for _, a := range annotations {
+		events = append(events, a.event())
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].CreatedAt.Before(events[j].CreatedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// detectLifecycleEvents compares an incoming report with what the hub last
+// stored for the instance to spot reboots, recreates and moves, as well as
+// new instances taking over the index of an old one.
+func detectLifecycleEvents(dbClient *sqlx.DB, systemInfo info.Info) ([]Event, error) {
+	var (
+		events   []Event
+		previous Metrics
+	)
+
+	err := dbClient.Get(&previous, "select * from metrics where instance_id = $1", systemInfo.Spec.ID)
+	if err == sql.ErrNoRows {
+		events = append(events, newEvent(systemInfo, eventFirstSeen, "first report from "+systemInfo.Spec.IP))
+
+		// rows of instances replaced before stay around, so only the
+		// instance that held the index last was taken over
+		var replaced string
+		err = dbClient.Get(&replaced, `
+		select instance_id from metrics
+		where deployment = $1 and name = $2 and instance_index = $3 and instance_id != $4
+		order by updated_at desc, id desc limit 1
+		`, systemInfo.Spec.Deployment, systemInfo.Spec.InstanceName, systemInfo.Spec.Index, systemInfo.Spec.ID)
+		if err == sql.ErrNoRows {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, newEvent(systemInfo, eventIndexReassigned,
+			fmt.Sprintf("%s/%s/%d was taken over by %s, previously %s",
+				systemInfo.Spec.Deployment, systemInfo.Spec.InstanceName, systemInfo.Spec.Index, systemInfo.Spec.ID, replaced)))
+
+		return events, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(previous.Uptime) > systemInfo.Stats.Uptime {
+		events = append(events, newEvent(systemInfo, eventRebooted,
+			fmt.Sprintf("uptime went from %ds to %ds", previous.Uptime, systemInfo.Stats.Uptime)))
+	}
+
+	if previous.IP != "" && previous.IP != systemInfo.Spec.IP {
+		events = append(events, newEvent(systemInfo, eventRecreated,
+			fmt.Sprintf("ip changed from %s to %s", previous.IP, systemInfo.Spec.IP)))
+	}
+
+	if previous.AZ != "" && previous.AZ != systemInfo.Spec.AZ {
+		events = append(events, newEvent(systemInfo, eventMoved,
+			fmt.Sprintf("az changed from %s to %s", previous.AZ, systemInfo.Spec.AZ)))
+	}
+
+	return events, nil
+}
+
+func getEventsFromDB(dbClient *sqlx.DB, deployment string, instanceID string, since time.Time) (events []Event, err error) {
+	err = dbClient.Select(&events, `
+	select * from events
+	where ($1 = '' or deployment = $1)
+	and ($2 = '' or instance_id = $2)
+	and created_at >= $3
+	order by created_at, id
+	`, deployment, instanceID, sqlTime(since))
+	return
+}
+
+func writeEvents(dbClient *sqlx.DB, events []Event, logger *log.Logger) {
+	for _, event := range events {
+		if err := writeEventToDB(dbClient, event); err != nil {
+			logger.Printf("Error writing %s event to db for %s: %s\n", event.Kind, event.InstanceID, err)
+		}
+	}
+}
+
+func writeEventToDB(dbClient *sqlx.DB, event Event) error {
+	_, err := dbClient.Exec(`
+	insert into events (
+	  instance_id,
+	  deployment,
+	  name,
+	  instance_index,
+	  kind,
+	  message
+	) VALUES (
+	  $1,
+	  $2,
+	  $3,
+	  $4,
+	  $5,
+	  $6
+	  )
+	`,
+		event.InstanceID,
+		event.Deployment,
+		event.Name,
+		event.InstanceIndex,
+		event.Kind,
+		event.Message,
+	)
+
+	return err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/aemengo/bosh-deployment-dashboard/config"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+const flappingSchema = `
+	create table if not exists flapping (
+	  instance_id text not null,
+	  rule text not null,
+	  since timestamp default current_timestamp not null,
+	  primary key (instance_id, rule)
+	);
+	`
+
+const (
+	eventFlapping        = "flapping"
+	eventFlappingStopped = "flapping_stopped"
+)
+
+// checkFlapping tells whether the rule of an alert that just changed state
+// is flapping on its instance. It returns an event when the alert only
+// now started to flap, which is all operators hear about until it settles.
+func checkFlapping(dbClient *sqlx.DB, cfg config.Flapping, alert Alert) (bool, *Event, error) {
+	if cfg.Transitions == 0 {
+		return false, nil, nil
+	}
+
+	var flapping bool
+	err := dbClient.Get(&flapping, "select count(*) > 0 from flapping where instance_id = $1 and rule = $2", alert.InstanceID, alert.Rule)
+	if err != nil || flapping {
+		return flapping, nil, err
+	}
+
+	transitions, err := countTransitions(dbClient, alert.InstanceID, alert.Rule, time.Now().Add(-cfg.Window))
+	if err != nil || transitions < cfg.Transitions {
+		return false, nil, err
+	}
+
+	if _, err := dbClient.Exec("insert into flapping (instance_id, rule) values ($1, $2)", alert.InstanceID, alert.Rule); err != nil {
+		return false, nil, err
+	}
+
+	if err := touchInstance(dbClient, alert.InstanceID); err != nil {
+		return false, nil, err
+	}
+
+	event := alertEvent(alert)
+	event.Kind = eventFlapping
+	event.Message = fmt.Sprintf("%s: fired or resolved %d times within %s, holding notifications until it settles", alert.Rule, transitions, cfg.Window)
+
+	return true, &event, nil
+}
+
+// settleFlapping stops treating the rules of an instance as flapping once
+// they went a whole window without firing or resolving, and returns a
+// notification with the state each one settled in.
+func settleFlapping(dbClient *sqlx.DB, cfg config.Flapping, instanceID string) ([]Notification, error) {
+	var rules []string
+
+	if err := dbClient.Select(&rules, "select rule from flapping where instance_id = $1", instanceID); err != nil {
+		return nil, err
+	}
+
+	var notifications []Notification
+	for _, rule := range rules {
+		transitions, err := countTransitions(dbClient, instanceID, rule, time.Now().Add(-cfg.Window))
+		if err != nil {
+			return nil, err
+		}
+
+		if transitions > 0 {
+			continue
+		}
+
+		var alert Alert
+		err = dbClient.Get(&alert, "select * from alerts where instance_id = $1 and rule = $2 order by id desc limit 1", instanceID, rule)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+
+		if _, err := dbClient.Exec("delete from flapping where instance_id = $1 and rule = $2", instanceID, rule); err != nil {
+			return nil, err
+		}
+
+		if err := touchInstance(dbClient, instanceID); err != nil {
+			return nil, err
+		}
+
+		event := alertEvent(alert)
+		event.Kind = eventFlappingStopped
+		event.Message = fmt.Sprintf("%s: stable for %s, settled %s", rule, cfg.Window, alert.State)
+		notifications = append(notifications, newAlertNotification(event, alert))
+	}
+
+	return notifications, nil
+}
+
+// countTransitions counts how often the rule fired or resolved on the
+// instance since the given time.
+func countTransitions(dbClient *sqlx.DB, instanceID string, rule string, since time.Time) (int, error) {
+	var count int
+
+	err := dbClient.Get(&count, `
+	select
+	  (select count(*) from alerts where instance_id = $1 and rule = $2 and fired_at >= $3) +
+	  (select count(*) from alerts where instance_id = $1 and rule = $2 and resolved_at >= $3)
+	`, instanceID, rule, sqlTime(since))
+
+	return count, err
+}
+
+func getFlappingInstances(dbClient *sqlx.DB) (map[string]bool, error) {
+	var instanceIDs []string
+
+	if err := dbClient.Select(&instanceIDs, "select distinct instance_id from flapping"); err != nil {
+		return nil, err
+	}
+
+	flapping := map[string]bool{}
+	for _, id := range instanceIDs {
+		flapping[id] = true
+	}
+
+	return flapping, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"github.com/aemengo/bosh-deployment-dashboard/config"
+	"github.com/jmoiron/sqlx"
+	"math"
+	"time"
+)
+
+const forecastsSchema = `
+	create table if not exists disk_forecasts (
+	  instance_id text not null primary key,
+	  stat text not null,
+	  value real not null,
+	  per_hour real not null,
+	  full_at timestamp,
+	  hours_to_full real,
+	  confidence real not null,
+	  samples integer not null
+	);
+	`
+
+const (
+	// fewer samples than this give no trend worth trusting
+	minForecastSamples = 10
+
+	// forecast alert rules ignore fits explaining less of the variance
+	minForecastConfidence = 0.5
+)
+
+// Forecast extrapolates the linear trend of a stat to when it reaches 100.
+// Confidence is the R² of the fit, from 0 (no trend) to 1 (a straight
+// line). FullAt is only set for stats that are growing.
+type Forecast struct {
+	InstanceID  string     `json:"instance_id" db:"instance_id"`
+	Stat        string     `json:"stat" db:"stat"`
+	Value       float64    `json:"value" db:"value"`
+	PerHour     float64    `json:"per_hour" db:"per_hour"`
+	FullAt      *time.Time `json:"full_at,omitempty" db:"full_at"`
+	HoursToFull *float64   `json:"hours_to_full,omitempty" db:"hours_to_full"`
+	Confidence  float64    `json:"confidence" db:"confidence"`
+	Samples     int        `json:"samples" db:"samples"`
+}
+
+// forecastStat fits a least squares line to the stat over the samples,
+// which must be in time order. ok is false without enough samples.
+func forecastStat(samples []Sample, stat string, now time.Time) (Forecast, bool) {
+	if len(samples) < minForecastSamples {
+		return Forecast{}, false
+	}
+
+	var (
+		start                           = samples[0].CreatedAt
+		n                               = float64(len(samples))
+		sumX, sumY, sumXY, sumXX, sumYY float64
+	)
+
+	for _, s := range samples {
+		x := s.CreatedAt.Sub(start).Hours()
+		y, _ := statValue(s.metrics(), stat)
+
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+		sumYY += y * y
+	}
+
+	varX := n*sumXX - sumX*sumX
+	varY := n*sumYY - sumY*sumY
+	covXY := n*sumXY - sumX*sumY
+
+	if varX == 0 {
+		return Forecast{}, false
+	}
+
+	slope := covXY / varX
+	intercept := (sumY - slope*sumX) / n
+
+	f := Forecast{
+		InstanceID: samples[0].InstanceID,
+		Stat:       stat,
+		PerHour:    slope,
+		Samples:    len(samples),
+	}
+
+	f.Value, _ = statValue(samples[len(samples)-1].metrics(), stat)
+
+	if varY > 0 {
+		f.Confidence = covXY * covXY / (varX * varY)
+	}
+
+	if slope > 0 {
+		fitted := intercept + slope*now.Sub(start).Hours()
+		hours := math.Max(0, (100-fitted)/slope)
+		fullAt := now.Add(time.Duration(hours * float64(time.Hour))).UTC()
+
+		f.HoursToFull = &hours
+		f.FullAt = &fullAt
+	}
+
+	return f, true
+}
+
+// getForecast forecasts the stat of an instance from its history within
+// the lookback.
+func getForecast(dbClient *sqlx.DB, cfg config.Hub, instanceID string, stat string) (Forecast, bool, error) {
+	now := time.Now()
+
+	samples, err := getSeriesSamples(dbClient, cfg.Retention, instanceID, now.Add(-cfg.ForecastLookback), now)
+	if err != nil {
+		return Forecast{}, false, err
+	}
+
+	f, ok := forecastStat(samples, stat, now)
+	return f, ok, nil
+}
+
+// recordDiskForecast forecasts the persistent disk of an instance that
+// just reported, for GET /api/health to serve until its next report.
+func recordDiskForecast(dbClient *sqlx.DB, cfg config.Hub, instanceID string) error {
+	f, ok, err := getForecast(dbClient, cfg, instanceID, "persistent_disk_used")
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		_, err = dbClient.Exec("delete from disk_forecasts where instance_id = $1", instanceID)
+		return err
+	}
+
+	var fullAt interface{}
+	if f.FullAt != nil {
+		fullAt = sqlTime(*f.FullAt)
+	}
+
+	_, err = dbClient.Exec(`
+	insert or replace into disk_forecasts (
+	  instance_id,
+	  stat,
+	  value,
+	  per_hour,
+	  full_at,
+	  hours_to_full,
+	  confidence,
+	  samples
+	) values ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, f.InstanceID, f.Stat, f.Value, f.PerHour, fullAt, f.HoursToFull, f.Confidence, f.Samples)
+
+	return err
+}
+
+// getDiskForecasts returns the persistent disk forecasts of the instances
+// recorded when they last reported, keyed by instance ID.
+func getDiskForecasts(dbClient *sqlx.DB) (map[string]Forecast, error) {
+	var stored []Forecast
+	if err := dbClient.Select(&stored, "select * from disk_forecasts"); err != nil {
+		return nil, err
+	}
+
+	forecasts := map[string]Forecast{}
+	for _, f := range stored {
+		forecasts[f.InstanceID] = f
+	}
+
+	return forecasts, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/aemengo/bosh-deployment-dashboard/config"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"sort"
+)
+
+var statNames = []string{"cpu_used", "memory_used", "persistent_disk_used", "load_15"}
+
+// InstanceGroup rolls up the instances of a BOSH instance group, such as
+// cf/diego-cell, since capacity and quorum are properties of the group
+// rather than of single VMs.
+type InstanceGroup struct {
+	Deployment string                 `json:"deployment"`
+	Name       string                 `json:"name"`
+	Instances  int                    `json:"instances"`
+	Healthy    int                    `json:"healthy"`
+	Stale      int                    `json:"stale"`
+	Failing    int                    `json:"failing"`
+	Stats      map[string]StatSummary `json:"stats"`
+	Quorum     *QuorumStatus          `json:"quorum,omitempty"`
+}
+
+type StatSummary struct {
+	Min float64 `json:"min"`
+	Avg float64 `json:"avg"`
+	Max float64 `json:"max"`
+}
+
+func handleGetGroups(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, cfg config.Config, logger *log.Logger) {
+	groups, err := getInstanceGroups(dbClient, cfg.Hub.Quorums, r.URL.Query().Get("deployment"))
+	if err != nil {
+		logger.Printf("Error computing instance groups: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
+
+// getInstanceGroups rolls up the latest metrics of every instance group,
+// or only those of the given deployment, and checks them against their
+// quorum policies. Groups whose instances the director expects but which
+// none of them reports still show up, empty.
+func getInstanceGroups(dbClient *sqlx.DB, quorums []config.Quorum, deployment string) ([]InstanceGroup, error) {
+	var metrics []Metrics
+
+	if err := dbClient.Select(&metrics, "select * from metrics where $1 = '' or deployment = $1", deployment); err != nil {
+		return nil, err
+	}
+
+	statuses, err := getStatusesFromDB(dbClient)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		groups []InstanceGroup
+		index  = map[[2]string]int{}
+	)
+
+	for _, m := range metrics {
+		key := [2]string{m.Deployment, m.Name}
+
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, InstanceGroup{Deployment: m.Deployment, Name: m.Name, Stats: map[string]StatSummary{}})
+		}
+
+		group := &groups[i]
+		group.Instances++
+
+		switch statuses[m.InstanceID] {
+		case statusHealthy:
+			group.Healthy++
+		case statusStale:
+			group.Stale++
+		case statusFailing:
+			group.Failing++
+		}
+
+		for _, stat := range statNames {
+			value, _ := statValue(m, stat)
+
+			summary, ok := group.Stats[stat]
+			if !ok || value < summary.Min {
+				summary.Min = value
+			}
+			if !ok || value > summary.Max {
+				summary.Max = value
+			}
+
+			// keep the sum until every instance is counted
+			summary.Avg += value
+			group.Stats[stat] = summary
+		}
+	}
+
+	discrepancies, err := getDiscrepancies(dbClient)
+	if err != nil {
+		return nil, err
+	}
+
+	// the director expects the instances that report, apart from orphaned
+	// ones, and those whose agent does not report, which reconciliation
+	// records only while it is on
+	expected := map[[2]string]int{}
+	for _, group := range groups {
+		expected[[2]string{group.Deployment, group.Name}] = group.Instances
+	}
+
+	for _, d := range discrepancies {
+		if deployment != "" && d.Deployment != deployment {
+			continue
+		}
+
+		key := [2]string{d.Deployment, d.Name}
+
+		switch d.State {
+		case orphaned:
+			expected[key]--
+		case missingAgent:
+			if _, ok := index[key]; !ok {
+				index[key] = len(groups)
+				groups = append(groups, InstanceGroup{Deployment: d.Deployment, Name: d.Name, Stats: map[string]StatSummary{}})
+			}
+			expected[key]++
+		}
+	}
+
+	for i := range groups {
+		for stat, summary := range groups[i].Stats {
+			summary.Avg /= float64(groups[i].Instances)
+			groups[i].Stats[stat] = summary
+		}
+
+		groups[i].Quorum = quorumStatus(quorums, groups[i], expected[[2]string{groups[i].Deployment, groups[i].Name}])
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Deployment != groups[j].Deployment {
+			return groups[i].Deployment < groups[j].Deployment
+		}
+		return groups[i].Name < groups[j].Name
+	})
+
+	return groups, nil
+}
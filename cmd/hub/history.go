@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/aemengo/bosh-deployment-dashboard/config"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"time"
+)
+
+const historySchema = `
+	create table if not exists history (
+	  id integer not null primary key,
+	  instance_id text not null,
+	  cpu_used real not null default 0,
+	  memory_used real not null default 0,
+	  persistent_disk_used real not null default 0,
+	  load_15 real not null default 0,
+	  created_at timestamp default current_timestamp not null
+	);
+
+	create index if not exists history_instance_id_created_at on history (instance_id, created_at);
+	`
+
+// Sample is the stats of an instance at one point in its history.
+type Sample struct {
+	InstanceID         string    `json:"-" db:"instance_id"`
+	CpuUsed            float64   `json:"cpu_used" db:"cpu_used"`
+	MemoryUsed         float64   `json:"memory_used" db:"memory_used"`
+	PersistentDiskUsed float64   `json:"persistent_disk_used" db:"persistent_disk_used"`
+	Load15             float64   `json:"load_15" db:"load_15"`
+	CreatedAt          time.Time `json:"created_at" db:"created_at"`
+}
+
+func (s Sample) metrics() Metrics {
+	return Metrics{
+		InstanceID:         s.InstanceID,
+		CpuUsed:            s.CpuUsed,
+		MemoryUsed:         s.MemoryUsed,
+		PersistentDiskUsed: s.PersistentDiskUsed,
+		Load15:             s.Load15,
+	}
+}
+
+// History is the series of an instance at the tier best suited to the
+// requested range and step.
+type History struct {
+	InstanceID  string       `json:"instance_id"`
+	Tier        string       `json:"tier"`
+	Points      []Point      `json:"points"`
+	Annotations []Annotation `json:"annotations"`
+}
+
+func handleGetHistory(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, cfg config.Config, logger *log.Logger) {
+	var (
+		query = r.URL.Query()
+		to    = time.Now()
+		from  = to.Add(-24 * time.Hour)
+		err   error
+	)
+
+	instanceID := query.Get("instance_id")
+	if instanceID == "" {
+		logger.Printf("Error history request is missing an instance_id\n")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if s := query.Get("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			logger.Printf("Error parsing from parameter %q: %s\n", s, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if s := query.Get("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			logger.Printf("Error parsing to parameter %q: %s\n", s, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	step := to.Sub(from) / maxHistoryPoints
+
+	if s := query.Get("step"); s != "" {
+		if step, err = time.ParseDuration(s); err != nil || step <= 0 {
+			logger.Printf("Error parsing step parameter %q: %v\n", s, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	tier := chooseTier(cfg.Hub.Retention, from, step)
+	history := History{InstanceID: instanceID, Tier: tier.name}
+
+	if history.Points, err = getSeries(dbClient, tier, instanceID, from, to); err != nil {
+		logger.Printf("Error retrieving history of %s from DB: %s\n", instanceID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if history.Annotations, err = getAnnotationsFromDB(dbClient, "", instanceID, from, to); err != nil {
+		logger.Printf("Error retrieving annotations for %s from DB: %s\n", instanceID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+func getSamplesFromDB(dbClient *sqlx.DB, instanceID string, from time.Time, to time.Time) (samples []Sample, err error) {
+	err = dbClient.Select(&samples, `
+	select instance_id, cpu_used, memory_used, persistent_disk_used, load_15, created_at from history
+	where instance_id = $1 and created_at >= $2 and created_at <= $3
+	order by created_at
+	`, instanceID, sqlTime(from), sqlTime(to))
+	return
+}
+
+func writeSampleToDB(dbClient *sqlx.DB, metrics Metrics) error {
+	_, err := dbClient.Exec(`
+	insert into history (
+	  instance_id,
+	  cpu_used,
+	  memory_used,
+	  persistent_disk_used,
+	  load_15
+	) VALUES (
+	  $1,
+	  $2,
+	  $3,
+	  $4,
+	  $5
+	  )
+	`,
+		metrics.InstanceID,
+		metrics.CpuUsed,
+		metrics.MemoryUsed,
+		metrics.PersistentDiskUsed,
+		metrics.Load15,
+	)
+	return err
+}
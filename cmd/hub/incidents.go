@@ -0,0 +1,504 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/aemengo/bosh-deployment-dashboard/config"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const incidentsSchema = `
+	create table if not exists incidents (
+	  id integer not null primary key,
+	  scope text not null,
+	  value text not null,
+	  state text not null,
+	  opened_at timestamp default current_timestamp not null,
+	  resolved_at timestamp
+	);
+
+	create table if not exists incident_instances (
+	  incident_id integer not null,
+	  instance_id text not null,
+	  deployment text,
+	  name text,
+	  instance_index integer,
+	  az text,
+	  kind text,
+	  joined_at timestamp default current_timestamp not null,
+	  primary key (incident_id, instance_id)
+	);
+	`
+
+const (
+	incidentOpen     = "open"
+	incidentResolved = "resolved"
+
+	incidentScopeAZ         = "az"
+	incidentScopeDeployment = "deployment"
+
+	eventIncidentOpened   = "incident_opened"
+	eventIncidentResolved = "incident_resolved"
+)
+
+// Incident groups instances that failed around the same time and share an
+// AZ or a deployment, which usually means they share a root cause.
+type Incident struct {
+	ID         int                `json:"id" db:"id"`
+	Scope      string             `json:"scope" db:"scope"`
+	Value      string             `json:"value" db:"value"`
+	State      string             `json:"state" db:"state"`
+	OpenedAt   time.Time          `json:"opened_at" db:"opened_at"`
+	ResolvedAt *time.Time         `json:"resolved_at,omitempty" db:"resolved_at"`
+	Instances  []IncidentInstance `json:"instances" db:"-"`
+}
+
+type IncidentInstance struct {
+	IncidentID    int       `json:"-" db:"incident_id"`
+	InstanceID    string    `json:"instance_id" db:"instance_id"`
+	Deployment    string    `json:"deployment" db:"deployment"`
+	Name          string    `json:"name" db:"name"`
+	InstanceIndex int       `json:"instance_index" db:"instance_index"`
+	AZ            string    `json:"az" db:"az"`
+	Kind          string    `json:"kind" db:"kind"`
+	JoinedAt      time.Time `json:"joined_at" db:"joined_at"`
+}
+
+func (i Incident) event(kind string, message string) Event {
+	return Event{Kind: kind, Message: message, Deployment: i.deployment()}
+}
+
+// deployment is the deployment every instance of the incident belongs to,
+// if they all belong to one, so that routes and silences by deployment
+// apply to incidents within an AZ too.
+func (i Incident) deployment() string {
+	if i.Scope == incidentScopeDeployment {
+		return i.Value
+	}
+
+	var deployment string
+	for n, instance := range i.Instances {
+		if n > 0 && instance.Deployment != deployment {
+			return ""
+		}
+		deployment = instance.Deployment
+	}
+
+	return deployment
+}
+
+func (i Incident) notification(event Event) Notification {
+	n := newNotification(event, Metrics{})
+	if i.Scope == incidentScopeAZ {
+		n.AZ = i.Value
+	}
+	return n
+}
+
+func handleGetIncidents(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, logger *log.Logger) {
+	incidents, err := getIncidentsFromDB(dbClient, r.URL.Query().Get("state"))
+	if err != nil {
+		logger.Printf("Error retrieving incidents from DB: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(incidents)
+}
+
+// correlateIncidents looks at the instances that went stale or started
+// failing within the window and are still down. Every AZ, and failing that
+// every deployment, with enough of them gets an open incident, and open
+// incidents whose instances all recovered are resolved. It returns the
+// events of incidents that opened or resolved.
+func correlateIncidents(dbClient *sqlx.DB, cfg config.Incidents) ([]Event, []Notification, error) {
+	var failures []IncidentInstance
+
+	err := dbClient.Select(&failures, `
+	select e.instance_id, m.deployment, m.name, m.instance_index, m.az, e.kind
+	from events e
+	join metrics m on m.instance_id = e.instance_id
+	join instance_status s on s.instance_id = e.instance_id
+	where e.id in (
+	  select max(id) from events
+	  where kind in ($1, $2) and created_at >= $3
+	  group by instance_id
+	) and s.status in ($4, $5)
+	order by m.deployment, m.name, m.instance_index
+	`, eventWentStale, eventAlertFired, sqlTime(time.Now().Add(-cfg.Window)), statusStale, statusFailing)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		events        []Event
+		notifications []Notification
+		byAZ          = map[string][]IncidentInstance{}
+		byDeployment  = map[string][]IncidentInstance{}
+	)
+
+	for _, f := range failures {
+		if f.AZ != "" {
+			byAZ[f.AZ] = append(byAZ[f.AZ], f)
+		}
+	}
+
+	correlate := func(scope string, groups map[string][]IncidentInstance) (map[string]bool, error) {
+		covered := map[string]bool{}
+
+		for value, instances := range groups {
+			if len(instances) < cfg.MinInstances {
+				continue
+			}
+
+			incident, opened, err := openIncident(dbClient, scope, value, instances)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, instance := range instances {
+				covered[instance.InstanceID] = true
+			}
+
+			if opened {
+				event := incident.event(eventIncidentOpened, describeIncident(incident))
+				events = append(events, event)
+				notifications = append(notifications, incident.notification(event))
+			}
+		}
+
+		return covered, nil
+	}
+
+	coveredByAZ, err := correlate(incidentScopeAZ, byAZ)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, f := range failures {
+		if !coveredByAZ[f.InstanceID] {
+			byDeployment[f.Deployment] = append(byDeployment[f.Deployment], f)
+		}
+	}
+
+	if _, err := correlate(incidentScopeDeployment, byDeployment); err != nil {
+		return nil, nil, err
+	}
+
+	resolved, err := resolveIncidents(dbClient)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, incident := range resolved {
+		message := fmt.Sprintf("%s %s: all %d instance(s) recovered", incident.Scope, incident.Value, len(incident.Instances))
+		event := incident.event(eventIncidentResolved, message)
+		events = append(events, event)
+		notifications = append(notifications, incident.notification(event))
+	}
+
+	return events, notifications, nil
+}
+
+// openIncident adds the instances to the open incident of the scope,
+// opening one if there is none yet.
+func openIncident(dbClient *sqlx.DB, scope string, value string, instances []IncidentInstance) (Incident, bool, error) {
+	var (
+		incident Incident
+		opened   bool
+	)
+
+	err := dbClient.Get(&incident, "select * from incidents where scope = $1 and value = $2 and state = $3", scope, value, incidentOpen)
+	if err != nil && err != sql.ErrNoRows {
+		return Incident{}, false, err
+	}
+
+	if err == sql.ErrNoRows {
+		result, err := dbClient.Exec("insert into incidents (scope, value, state) values ($1, $2, $3)", scope, value, incidentOpen)
+		if err != nil {
+			return Incident{}, false, err
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			return Incident{}, false, err
+		}
+
+		if err := dbClient.Get(&incident, "select * from incidents where id = $1", id); err != nil {
+			return Incident{}, false, err
+		}
+
+		opened = true
+	}
+
+	for _, instance := range instances {
+		_, err := dbClient.Exec(`
+		insert or ignore into incident_instances (
+		  incident_id,
+		  instance_id,
+		  deployment,
+		  name,
+		  instance_index,
+		  az,
+		  kind
+		) VALUES (
+		  $1,
+		  $2,
+		  $3,
+		  $4,
+		  $5,
+		  $6,
+		  $7
+		  )
+		`,
+			incident.ID,
+			instance.InstanceID,
+			instance.Deployment,
+			instance.Name,
+			instance.InstanceIndex,
+			instance.AZ,
+			instance.Kind,
+		)
+		if err != nil {
+			return Incident{}, false, err
+		}
+	}
+
+	incident.Instances, err = getIncidentInstances(dbClient, incident.ID)
+	return incident, opened, err
+}
+
+// resolveIncidents resolves the open incidents none of whose instances are
+// stale or failing anymore.
+func resolveIncidents(dbClient *sqlx.DB) ([]Incident, error) {
+	var incidents []Incident
+
+	err := dbClient.Select(&incidents, `
+	select * from incidents i
+	where i.state = $1 and not exists (
+	  select 1 from incident_instances ii
+	  join instance_status s on s.instance_id = ii.instance_id
+	  where ii.incident_id = i.id and s.status in ($2, $3)
+	)
+	`, incidentOpen, statusStale, statusFailing)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, incident := range incidents {
+		if _, err := dbClient.Exec("update incidents set state = $1, resolved_at = current_timestamp where id = $2", incidentResolved, incident.ID); err != nil {
+			return nil, err
+		}
+
+		if incidents[i].Instances, err = getIncidentInstances(dbClient, incident.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return incidents, nil
+}
+
+func describeIncident(incident Incident) string {
+	var (
+		deployments = map[string]bool{}
+		names       []string
+	)
+
+	for _, instance := range incident.Instances {
+		deployments[instance.Deployment] = true
+		names = append(names, fmt.Sprintf("%s/%s/%d", instance.Deployment, instance.Name, instance.InstanceIndex))
+	}
+
+	sort.Strings(names)
+
+	return fmt.Sprintf("%s %s: %d instance(s) down across %d deployment(s): %s",
+		incident.Scope, incident.Value, len(incident.Instances), len(deployments), strings.Join(names, ", "))
+}
+
+// openIncidentFor returns the open incident that already covers the
+// instance a notification is about, if any.
+func openIncidentFor(dbClient *sqlx.DB, instanceID string) (int, error) {
+	var ids []int
+
+	err := dbClient.Select(&ids, `
+	select i.id from incidents i
+	join incident_instances ii on ii.incident_id = i.id
+	where i.state = $1 and ii.instance_id = $2
+	`, incidentOpen, instanceID)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	return ids[0], nil
+}
+
+func getIncidentsFromDB(dbClient *sqlx.DB, state string) ([]Incident, error) {
+	var incidents []Incident
+
+	err := dbClient.Select(&incidents, "select * from incidents where $1 = '' or state = $1 order by opened_at desc, id desc", state)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range incidents {
+		if incidents[i].Instances, err = getIncidentInstances(dbClient, incidents[i].ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return incidents, nil
+}
+
+func getIncidentInstances(dbClient *sqlx.DB, incidentID int) (instances []IncidentInstance, err error) {
+	err = dbClient.Select(&instances, "select * from incident_instances where incident_id = $1 order by deployment, name, instance_index", incidentID)
+	return
+}
+
+// heldNotifier holds back notifications of instances going stale or alerts
+// firing, so that failures correlated into an incident meanwhile are only
+// told about as that incident, and recover along with it. A failure that
+// recovers while held is not told about at all, and neither is its
+// recovery.
+type heldNotifier struct {
+	notifier Notifier
+	dbClient *sqlx.DB
+	hold     time.Duration
+	logger   *log.Logger
+
+	mu       sync.Mutex
+	held     map[string]*heldNotification
+	released map[string]outcome
+}
+
+// outcome is what became of a failure once it was no longer held.
+type outcome int
+
+const (
+	releaseSent outcome = iota + 1
+	releaseToIncident
+)
+
+type heldNotification struct {
+	notification Notification
+	timer        *time.Timer
+}
+
+func newHeldNotifier(notifier Notifier, dbClient *sqlx.DB, hold time.Duration, logger *log.Logger) *heldNotifier {
+	return &heldNotifier{
+		notifier: notifier,
+		dbClient: dbClient,
+		hold:     hold,
+		logger:   logger,
+		held:     map[string]*heldNotification{},
+		released: map[string]outcome{},
+	}
+}
+
+// failureKey pairs a failure with its recovery: an instance going stale
+// with it coming back, and an alert firing with it resolving.
+func failureKey(n Notification) string {
+	if n.Kind == eventWentStale || n.Kind == eventCameBack {
+		return n.InstanceID
+	}
+	return n.InstanceID + "\x00" + n.Rule
+}
+
+func (h *heldNotifier) Notify(notifications []Notification) error {
+	var now []Notification
+
+	h.mu.Lock()
+
+	for _, n := range notifications {
+		key := failureKey(n)
+
+		switch n.Kind {
+		case eventWentStale, eventAlertFired:
+			if previous, ok := h.held[key]; ok {
+				previous.timer.Stop()
+			}
+
+			held := &heldNotification{notification: n}
+			held.timer = time.AfterFunc(h.hold, func() { h.release(key, held) })
+			h.held[key] = held
+		case eventCameBack, eventAlertResolved:
+			held, ok := h.held[key]
+			if ok {
+				held.timer.Stop()
+				delete(h.held, key)
+			}
+
+			released := h.released[key]
+			delete(h.released, key)
+
+			if (ok && released != releaseSent) || released == releaseToIncident {
+				continue
+			}
+
+			now = append(now, n)
+		default:
+			now = append(now, n)
+		}
+	}
+
+	h.mu.Unlock()
+
+	if len(now) == 0 {
+		return nil
+	}
+
+	return h.notifier.Notify(now)
+}
+
+// toIncident records that a failure is only told about as part of an
+// incident, so that its recovery is not told about either.
+func (h *heldNotifier) toIncident(n Notification) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.released[failureKey(n)] = releaseToIncident
+}
+
+// holding tells whether the failure a notification is about is still held
+// back, and so not told about yet.
+func (h *heldNotifier) holding(n Notification) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	_, ok := h.held[failureKey(n)]
+	return ok
+}
+
+func (h *heldNotifier) release(key string, held *heldNotification) {
+	h.mu.Lock()
+	if h.held[key] != held {
+		h.mu.Unlock()
+		return
+	}
+	delete(h.held, key)
+	h.mu.Unlock()
+
+	n := held.notification
+	if silenced(h.dbClient, n, h.logger) {
+		return
+	}
+
+	released := releaseToIncident
+	if !partOfIncident(h.dbClient, n, h.logger) {
+		if err := h.notifier.Notify([]Notification{n}); err != nil {
+			h.logger.Printf("Error sending %s notification for %s: %s\n", n.Kind, n.InstanceID, err)
+		}
+		released = releaseSent
+	}
+
+	h.mu.Lock()
+	h.released[key] = released
+	h.mu.Unlock()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/aemengo/bosh-deployment-dashboard/info"
+	"github.com/aemengo/bosh-deployment-dashboard/system"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"time"
+)
+
+const inventorySchema = `
+	create table if not exists inventory (
+	  id integer not null primary key,
+	  instance_id text unique,
+	  name text,
+	  deployment text,
+	  instance_index integer,
+	  label text,
+	  cpu_count integer,
+	  cpu_model text,
+	  memory_total integer,
+	  disks text,
+	  kernel_version text,
+	  os text,
+	  stemcell_version text,
+	  agent_version text,
+	  updated_at timestamp default current_timestamp not null
+	);
+	`
+
+type Disks []system.Disk
+
+func (d *Disks) Scan(src interface{}) error {
+	return scanJSON(src, d)
+}
+
+func (d Disks) Value() (driver.Value, error) {
+	return valueJSON(d)
+}
+
+type Inventory struct {
+	ID              int       `json:"id" db:"id"`
+	InstanceID      string    `json:"instance_id" db:"instance_id"`
+	Name            string    `json:"name" db:"name"`
+	Deployment      string    `json:"deployment" db:"deployment"`
+	InstanceIndex   int       `json:"instance_index" db:"instance_index"`
+	Label           string    `json:"label" db:"label"`
+	CPUCount        int       `json:"cpu_count" db:"cpu_count"`
+	CPUModel        string    `json:"cpu_model" db:"cpu_model"`
+	MemoryTotal     uint64    `json:"memory_total" db:"memory_total"`
+	Disks           Disks     `json:"disks" db:"disks"`
+	KernelVersion   string    `json:"kernel_version" db:"kernel_version"`
+	OS              string    `json:"os" db:"os"`
+	StemcellVersion string    `json:"stemcell_version" db:"stemcell_version"`
+	AgentVersion    string    `json:"agent_version" db:"agent_version"`
+	UpdatedAt       time.Time `json:"updated_at" db:"updated_at"`
+}
+
+type InventorySummary struct {
+	InstanceCount    int            `json:"instance_count"`
+	CPUCount         int            `json:"cpu_count"`
+	MemoryTotal      uint64         `json:"memory_total"`
+	StemcellVersions map[string]int `json:"stemcell_versions"`
+	KernelVersions   map[string]int `json:"kernel_versions"`
+	OperatingSystems map[string]int `json:"operating_systems"`
+	AgentVersions    map[string]int `json:"agent_versions"`
+	CPUModels        map[string]int `json:"cpu_models"`
+}
+
+type InventoryResponse struct {
+	Instances []Inventory      `json:"instances"`
+	Summary   InventorySummary `json:"summary"`
+}
+
+func handleGetInventory(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, logger *log.Logger) {
+	inventory, err := getInventoryFromDB(dbClient, r.URL.Query().Get("deployment"))
+	if err != nil {
+		logger.Printf("Error retrieving inventory from DB: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(InventoryResponse{
+		Instances: inventory,
+		Summary:   summarizeInventory(inventory),
+	})
+}
+
+func handlePostInventory(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, logger *log.Logger) {
+	var i info.InventoryInfo
+
+	if err := json.NewDecoder(r.Body).Decode(&i); err != nil {
+		logger.Printf("Error reading json body of request: %s\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := writeInventoryToDB(dbClient, i); err != nil {
+		logger.Printf("Error writing inventory to db for %s: %s\n", i.Spec.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
+}
+
+func summarizeInventory(inventory []Inventory) InventorySummary {
+	summary := InventorySummary{
+		StemcellVersions: map[string]int{},
+		KernelVersions:   map[string]int{},
+		OperatingSystems: map[string]int{},
+		AgentVersions:    map[string]int{},
+		CPUModels:        map[string]int{},
+	}
+
+	for _, i := range inventory {
+		summary.InstanceCount++
+		summary.CPUCount += i.CPUCount
+		summary.MemoryTotal += i.MemoryTotal
+		summary.StemcellVersions[i.StemcellVersion]++
+		summary.KernelVersions[i.KernelVersion]++
+		summary.OperatingSystems[i.OS]++
+		summary.AgentVersions[i.AgentVersion]++
+		summary.CPUModels[i.CPUModel]++
+	}
+
+	return summary
+}
+
+func getInventoryFromDB(dbClient *sqlx.DB, deployment string) (inventory []Inventory, err error) {
+	if deployment == "" {
+		err = dbClient.Select(&inventory, "select * from inventory")
+		return
+	}
+
+	err = dbClient.Select(&inventory, "select * from inventory where deployment = $1", deployment)
+	return
+}
+
+func writeInventoryToDB(dbClient *sqlx.DB, inventoryInfo info.InventoryInfo) error {
+	tx, err := dbClient.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	insert or replace into inventory (
+	  instance_id,
+	  name,
+	  deployment,
+	  instance_index,
+	  label,
+	  cpu_count,
+	  cpu_model,
+	  memory_total,
+	  disks,
+	  kernel_version,
+	  os,
+	  stemcell_version,
+	  agent_version
+	) VALUES (
+	  $1,
+	  $2,
+	  $3,
+	  $4,
+	  $5,
+	  $6,
+	  $7,
+	  $8,
+	  $9,
+	  $10,
+	  $11,
+	  $12,
+	  $13
+	  )
+	`,
+		inventoryInfo.Spec.ID,
+		inventoryInfo.Spec.InstanceName,
+		inventoryInfo.Spec.Deployment,
+		inventoryInfo.Spec.Index,
+		inventoryInfo.Label,
+		inventoryInfo.Inventory.CPUCount,
+		inventoryInfo.Inventory.CPUModel,
+		inventoryInfo.Inventory.MemoryTotal,
+		Disks(inventoryInfo.Inventory.Disks),
+		inventoryInfo.Inventory.KernelVersion,
+		inventoryInfo.Inventory.OS,
+		inventoryInfo.Inventory.StemcellVersion,
+		inventoryInfo.Inventory.AgentVersion,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := writeVersionsToDB(tx, inventoryInfo); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 	"time"
@@ -30,6 +31,14 @@ type Metrics struct {
 	Load15             float64   `json:"load_15" db:"load_15"`
 	Uptime             int       `json:"uptime" db:"uptime"`
 	UpdatedAt          time.Time `json:"-" db:"updated_at"`
+	Status             string    `json:"status" db:"-"`
+	Silences           []Silence `json:"silences,omitempty" db:"-"`
+	Drifted            bool      `json:"drifted" db:"-"`
+	Details            string    `json:"details,omitempty" db:"-"`
+	Flapping           bool      `json:"flapping" db:"-"`
+	Orphaned           bool      `json:"orphaned" db:"-"`
+	DiskForecast       *Forecast `json:"disk_forecast,omitempty" db:"-"`
+	Vitals
 }
 
 func main() {
@@ -51,6 +60,10 @@ func main() {
 		logger.Printf("Error opening database at %s: %s\n", cfg.Hub.DataDir+"/bdd-hub.db", err)
 	}
 
+	// sqlite only supports a single writer, and the hub now writes from
+	// background sweepers as well as from request handlers
+	db.SetMaxOpenConns(1)
+
 	dbClient := sqlx.NewDb(db, "sqlite3")
 
 	dbClient.MustExec(`
@@ -72,15 +85,246 @@ func main() {
 	  updated_at timestamp default current_timestamp not null
 	);
 	`)
+	dbClient.MustExec(inventorySchema)
+	dbClient.MustExec(versionsSchema)
+	dbClient.MustExec(eventsSchema)
+	dbClient.MustExec(statusSchema)
+	dbClient.MustExec(alertsSchema)
+	dbClient.MustExec(annotationsSchema)
+	dbClient.MustExec(silencesSchema)
+	dbClient.MustExec(acknowledgementsSchema)
+	dbClient.MustExec(flappingSchema)
+	dbClient.MustExec(incidentsSchema)
+	dbClient.MustExec(quorumSchema)
+	dbClient.MustExec(historySchema)
+	dbClient.MustExec(forecastsSchema)
+	dbClient.MustExec(rollupsSchema)
+	dbClient.MustExec(anomaliesSchema)
+	dbClient.MustExec(removedInstancesSchema)
+	dbClient.MustExec(reconciliationSchema)
+	dbClient.MustExec(identitySchema)
+
+	if err := migrateAlertsForAcknowledgements(dbClient); err != nil {
+		logger.Fatalf("Error migrating alerts table: %s\n", err)
+	}
+
+	if err := migrateAlertsForOutliers(dbClient); err != nil {
+		logger.Fatalf("Error migrating alerts table: %s\n", err)
+	}
+
+	if err := migrateStatusHistory(dbClient); err != nil {
+		logger.Fatalf("Error migrating status history: %s\n", err)
+	}
+
+	if err := migrateMetricsForVitals(dbClient); err != nil {
+		logger.Fatalf("Error migrating metrics table: %s\n", err)
+	}
+
+	if err := migrateIdentityHistory(dbClient); err != nil {
+		logger.Fatalf("Error migrating identity history: %s\n", err)
+	}
+
+	if err := validateAlertRules(cfg.Hub.Alerts); err != nil {
+		logger.Fatalf("Error %s\n", err)
+	}
+
+	if err := validateEmail(cfg.Hub.Email); err != nil {
+		logger.Fatalf("Error %s\n", err)
+	}
+
+	if err := validateQuorums(cfg.Hub.Quorums); err != nil {
+		logger.Fatalf("Error %s\n", err)
+	}
+
+	if err := validateSLOs(cfg.Hub.SLOs); err != nil {
+		logger.Fatalf("Error %s\n", err)
+	}
+
+	if err := validateDirector(cfg.Hub.Director); err != nil {
+		logger.Fatalf("Error %s\n", err)
+	}
+
+	defaultNotifier := multiNotifier{logNotifier{logger: logger}}
+	if cfg.Hub.Email.Host != "" {
+		defaultNotifier = append(defaultNotifier, newQueuedNotifier(emailNotifier{cfg: cfg.Hub.Email}, logger))
+	}
+
+	var notifier Notifier = defaultNotifier
+	if cfg.Hub.Route.Receiver != "" {
+		if notifier, err = newRouter(cfg.Hub, logger); err != nil {
+			logger.Fatalf("Error %s\n", err)
+		}
+	}
+
+	// repeats are about alerts told about before, so only new failures are
+	// held back until they can be correlated into incidents
+	held := newHeldNotifier(notifier, dbClient, cfg.Hub.Incidents.Hold, logger)
+
+	go runStaleSweeper(dbClient, cfg, held, logger)
+	go runAlertRepeater(dbClient, cfg, notifier, held, logger)
+	go runEmailDigest(dbClient, cfg, logger)
+	go runHistoryRollups(dbClient, logger)
+	go runHistoryPruner(dbClient, cfg, logger)
+
+	if cfg.Hub.Director.URL != "" {
+		go runReconciler(dbClient, cfg, logger)
+	}
+
+	if len(cfg.Hub.Director.Agentless) > 0 {
+		go runVitalsPoller(dbClient, cfg, held, logger)
+	}
 
 	http.Handle("/", http.FileServer(http.Dir(cfg.Hub.WebDir)))
 
 	http.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
-			handleGetHealth(w, r, dbClient, logger)
+			handleGetHealth(w, r, dbClient, cfg, logger)
+		case http.MethodPost:
+			handlePostHealth(w, r, dbClient, cfg, held, logger)
+		}
+	})
+
+	http.HandleFunc("/api/health/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodDelete:
+			handleDeleteHealth(w, r, dbClient, logger)
+		}
+	})
+
+	http.HandleFunc("/api/inventory", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleGetInventory(w, r, dbClient, logger)
+		case http.MethodPost:
+			handlePostInventory(w, r, dbClient, logger)
+		}
+	})
+
+	http.HandleFunc("/api/drift", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleGetDrift(w, r, dbClient, logger)
+		}
+	})
+
+	http.HandleFunc("/api/events", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleGetEvents(w, r, dbClient, logger)
+		}
+	})
+
+	http.HandleFunc("/api/alerts", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleGetAlerts(w, r, dbClient, logger)
+		}
+	})
+
+	http.HandleFunc("/api/alerts/", func(w http.ResponseWriter, r *http.Request) {
+		handleAlert(w, r, dbClient, logger)
+	})
+
+	http.HandleFunc("/api/annotations", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleGetAnnotations(w, r, dbClient, logger)
 		case http.MethodPost:
-			handlePostHealth(w, r, dbClient, logger)
+			handlePostAnnotation(w, r, dbClient, logger)
+		}
+	})
+
+	http.HandleFunc("/api/silences", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleGetSilences(w, r, dbClient, logger)
+		case http.MethodPost:
+			handlePostSilence(w, r, dbClient, logger)
+		}
+	})
+
+	http.HandleFunc("/api/silences/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodDelete:
+			handleDeleteSilence(w, r, dbClient, logger)
+		}
+	})
+
+	http.HandleFunc("/api/groups", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleGetGroups(w, r, dbClient, cfg, logger)
+		}
+	})
+
+	http.HandleFunc("/api/deployments", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleGetDeployments(w, r, dbClient, cfg, logger)
+		}
+	})
+
+	http.HandleFunc("/api/deployments/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodDelete:
+			handleDeleteDeployment(w, r, dbClient, logger)
+		}
+	})
+
+	http.HandleFunc("/api/outliers", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleGetOutliers(w, r, dbClient, cfg, logger)
+		}
+	})
+
+	http.HandleFunc("/api/anomalies", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleGetAnomalies(w, r, dbClient, logger)
+		}
+	})
+
+	http.HandleFunc("/api/history", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleGetHistory(w, r, dbClient, cfg, logger)
+		}
+	})
+
+	http.HandleFunc("/api/reports/rightsizing", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleGetRightsizing(w, r, dbClient, cfg, logger)
+		}
+	})
+
+	http.HandleFunc("/api/reports/availability", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleGetAvailabilityReport(w, r, dbClient, logger)
+		}
+	})
+
+	http.HandleFunc("/api/slos", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleGetSLOs(w, r, dbClient, cfg, logger)
+		}
+	})
+
+	http.HandleFunc("/api/reconciliation", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleGetReconciliation(w, r, dbClient, logger)
+		}
+	})
+
+	http.HandleFunc("/api/incidents", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handleGetIncidents(w, r, dbClient, logger)
 		}
 	})
 
@@ -88,7 +332,48 @@ func main() {
 	logger.Fatal(http.ListenAndServe(cfg.Hub.Addr(), nil))
 }
 
-func handleGetHealth(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, logger *log.Logger) {
+func handleGetHealth(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, cfg config.Config, logger *log.Logger) {
+	if s := r.URL.Query().Get("at"); s != "" {
+		at, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			logger.Printf("Error parsing at parameter %q: %s\n", s, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		snapshot, err := getSnapshot(dbClient, cfg.Hub, at)
+		if err != nil {
+			logger.Printf("Error reconstructing health at %s: %s\n", s, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, r, snapshot)
+		return
+	}
+
+	// the cursor is taken before reading, so that nothing written while
+	// this request runs is missed by the next one
+	now := time.Now()
+	cursor := newCursor(now)
+
+	version, err := getHealthVersion(dbClient, now)
+	if err != nil {
+		logger.Printf("Error retrieving version of system information from DB: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// changes since a cursor come in another shape than the whole fleet
+	since := r.URL.Query().Get("since")
+	if since != "" {
+		version += " since"
+	}
+
+	if notModified(w, r, newETag(version)) {
+		return
+	}
+
 	metrics, err := getMetricsFromDB(dbClient)
 	if err != nil {
 		logger.Printf("Error retrieving system information from DBs: %s\n", err)
@@ -96,11 +381,117 @@ func handleGetHealth(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB,
 		return
 	}
 
+	var (
+		removed   []string
+		sinceTime time.Time
+	)
+
+	if since != "" {
+		if sinceTime, err = parseCursor(since); err != nil {
+			logger.Printf("Error parsing since parameter %q: %s\n", since, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if metrics, removed, err = getChangesSince(dbClient, metrics, sinceTime); err != nil {
+			logger.Printf("Error retrieving changes since %s from DB: %s\n", since, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	statuses, err := getStatusesFromDB(dbClient)
+	if err != nil {
+		logger.Printf("Error retrieving instance statuses from DB: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	silences, err := getActiveSilences(dbClient, time.Now())
+	if err != nil {
+		logger.Printf("Error retrieving active silences from DB: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	drift, err := getDriftDetails(dbClient)
+	if err != nil {
+		logger.Printf("Error computing version drift: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	flapping, err := getFlappingInstances(dbClient)
+	if err != nil {
+		logger.Printf("Error retrieving flapping instances from DB: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	forecasts, err := getDiskForecasts(dbClient)
+	if err != nil {
+		logger.Printf("Error retrieving disk forecasts from DB: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	discrepancies, err := getDiscrepancies(dbClient)
+	if err != nil {
+		logger.Printf("Error retrieving reconciliation from DB: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	orphans := map[string]bool{}
+	for _, d := range discrepancies {
+		if d.State == orphaned {
+			orphans[d.InstanceID] = true
+		}
+	}
+
+	for i, m := range metrics {
+		metrics[i].Orphaned = orphans[m.InstanceID]
+
+		metrics[i].Status = statuses[m.InstanceID]
+		metrics[i].Flapping = flapping[m.InstanceID]
+
+		if f, ok := forecasts[m.InstanceID]; ok {
+			metrics[i].DiskForecast = &f
+		}
+
+		for _, silence := range silences {
+			if silence.matches(m) {
+				metrics[i].Silences = append(metrics[i].Silences, silence)
+			}
+		}
+
+		if components, ok := drift[m.InstanceID]; ok {
+			metrics[i].Drifted = true
+			metrics[i].Details = "drifted from instance group: " + strings.Join(components, ", ")
+		}
+	}
+
+	// instances whose agent never reported are listed as well, so that
+	// the dashboard shows them
+	for _, d := range discrepancies {
+		if d.State == missingAgent && !d.Since.Before(sinceTime) {
+			m := d.metrics()
+			m.Status = missingAgent
+			metrics = append(metrics, m)
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
+
+	if since != "" {
+		json.NewEncoder(w).Encode(Changes{Cursor: cursor, Instances: metrics, Removed: removed})
+		return
+	}
+
 	json.NewEncoder(w).Encode(metrics)
 }
 
-func handlePostHealth(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, logger *log.Logger) {
+func handlePostHealth(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, cfg config.Config, notifier Notifier, logger *log.Logger) {
 	var i info.Info
 
 	if err := json.NewDecoder(r.Body).Decode(&i); err != nil {
@@ -109,7 +500,7 @@ func handlePostHealth(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB,
 		return
 	}
 
-	if err := writeInfoToDB(dbClient, i); err != nil {
+	if err := recordHealth(dbClient, cfg, notifier, i, Vitals{Source: sourceAgent}, logger); err != nil {
 		logger.Printf("Error writing system information to db for %s: %s\n", i.Spec.ID, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -119,12 +510,141 @@ func handlePostHealth(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB,
 	w.Write([]byte("success"))
 }
 
+// recordHealth stores a report of the stats of an instance, from its agent
+// or pulled from the director, and works out everything that follows from
+// it: events, history, alerts, anomalies, status, quorums and incidents.
+// Only failing to store the report itself is an error.
+func recordHealth(dbClient *sqlx.DB, cfg config.Config, notifier Notifier, i info.Info, vitals Vitals, logger *log.Logger) error {
+	events, err := detectLifecycleEvents(dbClient, i)
+	if err != nil {
+		logger.Printf("Error detecting lifecycle events for %s: %s\n", i.Spec.ID, err)
+	}
+
+	if err := writeInfoToDB(dbClient, i, vitals); err != nil {
+		return err
+	}
+
+	m := metricsFromInfo(i)
+	m.Vitals = vitals
+	if err := recordIdentity(dbClient, m); err != nil {
+		logger.Printf("Error writing identity history for %s: %s\n", i.Spec.ID, err)
+	}
+
+	// an instance that starts reporting is no longer missing, even before
+	// the next reconciliation with the director
+	if _, err := dbClient.Exec("delete from reconciliation where instance_id = $1 and state = $2", i.Spec.ID, missingAgent); err != nil {
+		logger.Printf("Error updating reconciliation for %s: %s\n", i.Spec.ID, err)
+	}
+
+	var notifications []Notification
+
+	if err := writeSampleToDB(dbClient, metricsFromInfo(i)); err != nil {
+		logger.Printf("Error writing history to db for %s: %s\n", i.Spec.ID, err)
+	}
+
+	if err := recordDiskForecast(dbClient, cfg.Hub, i.Spec.ID); err != nil {
+		logger.Printf("Error forecasting disk usage of %s: %s\n", i.Spec.ID, err)
+	}
+
+	alerts, err := evaluateAlerts(dbClient, cfg.Hub, i)
+	if err != nil {
+		logger.Printf("Error evaluating alerts for %s: %s\n", i.Spec.ID, err)
+	}
+
+	for _, alert := range alerts {
+		event := alertEvent(alert)
+		events = append(events, event)
+
+		flapping, flappingEvent, err := checkFlapping(dbClient, cfg.Hub.Flapping, alert)
+		if err != nil {
+			logger.Printf("Error checking %s for flapping on %s: %s\n", alert.Rule, i.Spec.ID, err)
+		}
+
+		switch {
+		case flappingEvent != nil:
+			events = append(events, *flappingEvent)
+			notifications = append(notifications, newAlertNotification(*flappingEvent, alert))
+		case flapping:
+		default:
+			notifications = append(notifications, newAlertNotification(event, alert))
+		}
+	}
+
+	anomalyEvents, err := detectAnomalies(dbClient, cfg.Hub, metricsFromInfo(i))
+	if err != nil {
+		logger.Printf("Error detecting anomalies for %s: %s\n", i.Spec.ID, err)
+	}
+
+	events = append(events, anomalyEvents...)
+
+	settled, err := settleFlapping(dbClient, cfg.Hub.Flapping, i.Spec.ID)
+	if err != nil {
+		logger.Printf("Error settling flapping alerts for %s: %s\n", i.Spec.ID, err)
+	}
+
+	for _, n := range settled {
+		events = append(events, n.Event)
+		notifications = append(notifications, n)
+	}
+
+	statusEvents, err := evaluateStatus(dbClient, m)
+	if err != nil {
+		logger.Printf("Error evaluating status for %s: %s\n", i.Spec.ID, err)
+	}
+
+	for _, event := range statusEvents {
+		events = append(events, event)
+		if event.Kind == eventCameBack {
+			notifications = append(notifications, newNotification(event, metricsFromInfo(i)))
+		}
+	}
+
+	quorumNotifications, err := evaluateQuorums(dbClient, cfg.Hub.Quorums, i.Spec.Deployment)
+	if err != nil {
+		logger.Printf("Error evaluating quorums of %s: %s\n", i.Spec.Deployment, err)
+	}
+
+	for _, n := range quorumNotifications {
+		events = append(events, n.Event)
+		notifications = append(notifications, n)
+	}
+
+	writeEvents(dbClient, events, logger)
+
+	incidentEvents, incidentNotifications, err := correlateIncidents(dbClient, cfg.Hub.Incidents)
+	if err != nil {
+		logger.Printf("Error correlating incidents: %s\n", err)
+	}
+
+	writeEvents(dbClient, incidentEvents, logger)
+	sendNotifications(dbClient, notifier, append(notifications, incidentNotifications...), logger)
+	return nil
+}
+
+func metricsFromInfo(systemInfo info.Info) Metrics {
+	return Metrics{
+		InstanceID:         systemInfo.Spec.ID,
+		Name:               systemInfo.Spec.InstanceName,
+		Address:            systemInfo.Spec.Address,
+		AZ:                 systemInfo.Spec.AZ,
+		Deployment:         systemInfo.Spec.Deployment,
+		InstanceIndex:      systemInfo.Spec.Index,
+		IP:                 systemInfo.Spec.IP,
+		Label:              systemInfo.Label,
+		CpuUsed:            systemInfo.Stats.CpuUsed,
+		MemoryUsed:         systemInfo.Stats.MemoryUsed,
+		PersistentDiskUsed: systemInfo.Stats.PersistentDiskUsed,
+		Load15:             systemInfo.Stats.Load15,
+		Uptime:             int(systemInfo.Stats.Uptime),
+	}
+}
+
 func getMetricsFromDB(dbClient *sqlx.DB) (metrics []Metrics, err error) {
 	err = dbClient.Select(&metrics, "select * from metrics")
 	return
 }
 
-func writeInfoToDB(dbClient *sqlx.DB, systemInfo info.Info) error {
+func writeInfoToDB(dbClient *sqlx.DB, systemInfo info.Info, vitals Vitals) error {
 	_, err := dbClient.Exec(`
 	insert or replace into metrics (
 	  instance_id,
@@ -139,7 +659,13 @@ func writeInfoToDB(dbClient *sqlx.DB, systemInfo info.Info) error {
 	  memory_used,
 	  persistent_disk_used,
 	  load_15,
-	  uptime
+	  uptime,
+	  source,
+	  swap_used,
+	  system_disk_used,
+	  ephemeral_disk_used,
+	  process_state,
+	  processes
 	) VALUES (
 	  $1,
 	  $2,
@@ -153,7 +679,13 @@ func writeInfoToDB(dbClient *sqlx.DB, systemInfo info.Info) error {
 	  $10,
 	  $11,
 	  $12,
-	  $13
+	  $13,
+	  $14,
+	  $15,
+	  $16,
+	  $17,
+	  $18,
+	  $19
 	  )
 	`,
 		systemInfo.Spec.ID,
@@ -169,6 +701,12 @@ func writeInfoToDB(dbClient *sqlx.DB, systemInfo info.Info) error {
 		systemInfo.Stats.PersistentDiskUsed,
 		systemInfo.Stats.Load15,
 		systemInfo.Stats.Uptime,
+		vitals.Source,
+		vitals.SwapUsed,
+		vitals.SystemDiskUsed,
+		vitals.EphemeralDiskUsed,
+		vitals.ProcessState,
+		vitals.Processes,
 	)
 
 	return err
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"strings"
+	"time"
+)
+
+// Notification is what the hub tells operators about: an alert firing or
+// resolving, or an instance going stale and coming back.
+type Notification struct {
+	Event
+	Label    string `json:"label"`
+	AZ       string `json:"az"`
+	Severity string `json:"severity,omitempty"`
+	Rule     string `json:"rule,omitempty"`
+}
+
+func (n Notification) metrics() Metrics {
+	return Metrics{
+		InstanceID:    n.InstanceID,
+		Deployment:    n.Deployment,
+		Name:          n.Name,
+		InstanceIndex: n.InstanceIndex,
+		Label:         n.Label,
+		AZ:            n.AZ,
+	}
+}
+
+// Notifier delivers notifications. It usually gets one at a time, but a
+// route with a group_wait hands over everything collected in that window.
+type Notifier interface {
+	Notify(notifications []Notification) error
+}
+
+// multiNotifier hands notifications to every notifier it holds.
+type multiNotifier []Notifier
+
+func (m multiNotifier) Notify(notifications []Notification) error {
+	var failed []string
+
+	for _, notifier := range m {
+		if err := notifier.Notify(notifications); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+// notificationQueueSize is how many deliveries a queuedNotifier holds
+// before it drops further ones.
+const notificationQueueSize = 100
+
+// queuedNotifier hands notifications over to a notifier on a goroutine of
+// its own, so that a slow or unreachable receiver never holds up the
+// reports of agents. Deliveries that do not fit in the queue are dropped.
+type queuedNotifier struct {
+	queue chan []Notification
+}
+
+func newQueuedNotifier(notifier Notifier, logger *log.Logger) queuedNotifier {
+	q := queuedNotifier{queue: make(chan []Notification, notificationQueueSize)}
+
+	go func() {
+		for notifications := range q.queue {
+			if err := notifier.Notify(notifications); err != nil {
+				n := notifications[0]
+				logger.Printf("Error sending %s notification for %s: %s\n", n.Kind, n.InstanceID, err)
+			}
+		}
+	}()
+
+	return q
+}
+
+func (q queuedNotifier) Notify(notifications []Notification) error {
+	select {
+	case q.queue <- notifications:
+		return nil
+	default:
+		return errors.New("notification queue is full, dropped the notification")
+	}
+}
+
+// logNotifier writes notifications to the hub log.
+type logNotifier struct {
+	logger *log.Logger
+}
+
+func (l logNotifier) Notify(notifications []Notification) error {
+	for _, n := range notifications {
+		l.logger.Printf("[%s] %s/%s/%d (%s): %s\n", n.Kind, n.Deployment, n.Name, n.InstanceIndex, n.InstanceID, n.Message)
+	}
+	return nil
+}
+
+func newNotification(event Event, metrics Metrics) Notification {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now().UTC()
+	}
+
+	return Notification{
+		Event: event,
+		Label: metrics.Label,
+		AZ:    metrics.AZ,
+	}
+}
+
+func newAlertNotification(event Event, alert Alert) Notification {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now().UTC()
+	}
+
+	return Notification{
+		Event:    event,
+		Label:    alert.Label,
+		AZ:       alert.AZ,
+		Severity: alert.Severity,
+		Rule:     alert.Rule,
+	}
+}
+
+// sendNotifications hands notifications to the notifier unless a silence
+// suppresses them, or the failure they tell is part of an open incident.
+func sendNotifications(dbClient *sqlx.DB, notifier Notifier, notifications []Notification, logger *log.Logger) {
+	for _, n := range notifications {
+		if silenced(dbClient, n, logger) {
+			continue
+		}
+
+		if partOfIncident(dbClient, n, logger) {
+			// the failure recovers along with the incident it is told as
+			if held, ok := notifier.(*heldNotifier); ok {
+				held.toIncident(n)
+			}
+			continue
+		}
+
+		if err := notifier.Notify([]Notification{n}); err != nil {
+			logger.Printf("Error sending %s notification for %s: %s\n", n.Kind, n.InstanceID, err)
+		}
+	}
+}
+
+// silenced tells whether an active silence matches the instance a
+// notification is about.
+func silenced(dbClient *sqlx.DB, n Notification, logger *log.Logger) bool {
+	silences, err := getMatchingSilences(dbClient, n.metrics(), time.Now())
+	if err != nil {
+		logger.Printf("Error retrieving silences for %s: %s\n", n.InstanceID, err)
+	}
+
+	if len(silences) > 0 {
+		logger.Printf("Suppressed %s notification for %s, silenced by %d: %s\n", n.Kind, n.InstanceID, silences[0].ID, silences[0].Reason)
+		return true
+	}
+
+	return false
+}
+
+// partOfIncident tells whether the instance going stale or firing an alert
+// in a notification is already part of an open incident.
+func partOfIncident(dbClient *sqlx.DB, n Notification, logger *log.Logger) bool {
+	if n.Kind != eventWentStale && n.Kind != eventAlertFired {
+		return false
+	}
+
+	incidentID, err := openIncidentFor(dbClient, n.InstanceID)
+	if err != nil {
+		logger.Printf("Error retrieving incidents for %s: %s\n", n.InstanceID, err)
+	}
+
+	if incidentID != 0 {
+		logger.Printf("Suppressed %s notification for %s, part of incident %d\n", n.Kind, n.InstanceID, incidentID)
+		return true
+	}
+
+	return false
+}
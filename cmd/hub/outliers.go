@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/aemengo/bosh-deployment-dashboard/config"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultOutlierScore = 3.5
+
+	// instance groups smaller than this have no meaningful median
+	minOutlierPeers = 3
+
+	// outlierWindow is how much history the stats of peers are averaged
+	// over, so that a single spike does not make an outlier
+	outlierWindow = 5 * time.Minute
+)
+
+// Outlier is an instance whose stat is far from the median of the other
+// instances in its instance group.
+type Outlier struct {
+	InstanceID    string  `json:"instance_id"`
+	Deployment    string  `json:"deployment"`
+	Name          string  `json:"name"`
+	InstanceIndex int     `json:"instance_index"`
+	Stat          string  `json:"stat"`
+	Value         float64 `json:"value"`
+	Median        float64 `json:"median"`
+	MAD           float64 `json:"mad"`
+	Score         float64 `json:"score"`
+}
+
+func handleGetOutliers(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, cfg config.Config, logger *log.Logger) {
+	var (
+		query     = r.URL.Query()
+		threshold = defaultOutlierScore
+		stats     = statNames
+	)
+
+	if s := query.Get("threshold"); s != "" {
+		var err error
+		if threshold, err = strconv.ParseFloat(s, 64); err != nil {
+			logger.Printf("Error parsing threshold parameter %q: %s\n", s, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if stat := query.Get("stat"); stat != "" {
+		if _, ok := statValue(Metrics{}, stat); !ok {
+			logger.Printf("Error unknown stat %q\n", stat)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		stats = []string{stat}
+	}
+
+	metrics, err := getOutlierPeers(dbClient, cfg.Hub, query.Get("deployment"), "")
+	if err != nil {
+		logger.Printf("Error retrieving system information from DB: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	outliers := []Outlier{}
+	for _, stat := range stats {
+		for _, o := range findOutliers(metrics, stat) {
+			if math.Abs(o.Score) > threshold {
+				outliers = append(outliers, o)
+			}
+		}
+	}
+
+	sort.Slice(outliers, func(i, j int) bool { return math.Abs(outliers[i].Score) > math.Abs(outliers[j].Score) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(outliers)
+}
+
+// findOutliers scores the stat of every instance against the instances of
+// its instance group, skipping groups too small to compare.
+func findOutliers(metrics []Metrics, stat string) []Outlier {
+	groups := map[[2]string][]Metrics{}
+	for _, m := range metrics {
+		key := [2]string{m.Deployment, m.Name}
+		groups[key] = append(groups[key], m)
+	}
+
+	var outliers []Outlier
+	for _, peers := range groups {
+		if len(peers) < minOutlierPeers {
+			continue
+		}
+
+		values := make([]float64, len(peers))
+		for i, m := range peers {
+			values[i], _ = statValue(m, stat)
+		}
+
+		for i, m := range peers {
+			score, median, mad := outlierScore(values[i], values)
+			outliers = append(outliers, Outlier{
+				InstanceID:    m.InstanceID,
+				Deployment:    m.Deployment,
+				Name:          m.Name,
+				InstanceIndex: m.InstanceIndex,
+				Stat:          stat,
+				Value:         values[i],
+				Median:        median,
+				MAD:           mad,
+				Score:         score,
+			})
+		}
+	}
+
+	return outliers
+}
+
+// outlierScore is the modified z-score of value: its distance from the
+// median of values in units of the median absolute deviation, scaled to be
+// comparable with a standard deviation. When more than half of the values
+// are equal the MAD is zero, and the mean absolute deviation stands in.
+func outlierScore(value float64, values []float64) (score float64, median float64, mad float64) {
+	median = medianOf(values)
+
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - median)
+	}
+
+	mad = medianOf(deviations)
+
+	scale := 1.4826 * mad
+	if mad == 0 {
+		var sum float64
+		for _, d := range deviations {
+			sum += d
+		}
+		scale = 1.253314 * sum / float64(len(deviations))
+	}
+
+	if scale == 0 {
+		return 0, median, mad
+	}
+
+	return (value - median) / scale, median, mad
+}
+
+func medianOf(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+
+	return sorted[middle]
+}
+
+// peerOutlierScore scores the stat of an instance against the recent
+// stats of its instance group. ok is false when the group is too small.
+func peerOutlierScore(dbClient *sqlx.DB, cfg config.Hub, metrics Metrics, stat string) (score float64, ok bool, err error) {
+	peers, err := getOutlierPeers(dbClient, cfg, metrics.Deployment, metrics.Name)
+	if err != nil || len(peers) < minOutlierPeers {
+		return 0, false, err
+	}
+
+	value, _ := statValue(metrics, stat)
+
+	values := make([]float64, len(peers))
+	for i, m := range peers {
+		values[i], _ = statValue(m, stat)
+		if m.InstanceID == metrics.InstanceID {
+			value = values[i]
+		}
+	}
+
+	score, _, _ = outlierScore(value, values)
+
+	return score, true, nil
+}
+
+// getOutlierPeers lists the instances of a deployment, or of all of them,
+// and of an instance group, or of all of them, that are not stale, with
+// their stats averaged over the outlier window.
+func getOutlierPeers(dbClient *sqlx.DB, cfg config.Hub, deployment string, name string) ([]Metrics, error) {
+	var metrics []Metrics
+
+	err := dbClient.Select(&metrics, `
+	select * from metrics
+	where ($1 = '' or deployment = $1) and ($2 = '' or name = $2)
+	`, deployment, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var averages []Sample
+
+	err = dbClient.Select(&averages, `
+	select instance_id, avg(cpu_used) cpu_used, avg(memory_used) memory_used,
+	  avg(persistent_disk_used) persistent_disk_used, avg(load_15) load_15
+	from history
+	where created_at >= $1 and instance_id in (
+	  select instance_id from metrics where ($2 = '' or deployment = $2) and ($3 = '' or name = $3)
+	)
+	group by instance_id
+	`, sqlTime(time.Now().Add(-outlierWindow)), deployment, name)
+	if err != nil {
+		return nil, err
+	}
+
+	recent := map[string]Sample{}
+	for _, a := range averages {
+		recent[a.InstanceID] = a
+	}
+
+	var peers []Metrics
+
+	for _, m := range metrics {
+		staleAfter := cfg.StaleAfter
+		if m.Source == sourceDirector {
+			staleAfter = vitalsStaleAfter(cfg)
+		}
+
+		if m.UpdatedAt.Before(time.Now().Add(-staleAfter)) {
+			continue
+		}
+
+		if a, ok := recent[m.InstanceID]; ok {
+			m.CpuUsed = a.CpuUsed
+			m.MemoryUsed = a.MemoryUsed
+			m.PersistentDiskUsed = a.PersistentDiskUsed
+			m.Load15 = a.Load15
+		}
+
+		peers = append(peers, m)
+	}
+
+	return peers, nil
+}
+
+func migrateAlertsForOutliers(dbClient *sqlx.DB) error {
+	if err := addColumn(dbClient, "alerts", "rule_type", "text not null default 'threshold'"); err != nil {
+		return err
+	}
+
+	return addColumn(dbClient, "alerts", "score", "real not null default 0")
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const removedInstancesSchema = `
+	create table if not exists removed_instances (
+	  instance_id text not null primary key,
+	  removed_at timestamp default current_timestamp not null
+	);
+
+	create table if not exists instance_changes (
+	  instance_id text not null primary key,
+	  changed_at timestamp default current_timestamp not null
+	);
+	`
+
+// Changes are the instances that reported or changed status since a
+// cursor, and those removed since. Passing Cursor as the next since picks
+// up where this left off. Cursors have a resolution of one second, so
+// changes within the second of a cursor may come up twice.
+type Changes struct {
+	Cursor    string    `json:"cursor"`
+	Instances []Metrics `json:"instances"`
+	Removed   []string  `json:"removed"`
+}
+
+func parseCursor(cursor string) (time.Time, error) {
+	seconds, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(seconds, 0), nil
+}
+
+func newCursor(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// touchInstance records that something the hub shows along with an
+// instance changed, other than its report or status, such as it drifting
+// or being orphaned.
+func touchInstance(dbClient sqlx.Execer, instanceID string) error {
+	_, err := dbClient.Exec("insert or replace into instance_changes (instance_id) values ($1)", instanceID)
+	return err
+}
+
+// getChangesSince narrows the metrics down to the instances that changed
+// since the cursor time, and lists the instances removed since. Besides
+// reports and status changes, an instance changes when it is touched, and
+// when a silence matching it is created, starts or ends.
+func getChangesSince(dbClient *sqlx.DB, metrics []Metrics, since time.Time) ([]Metrics, []string, error) {
+	var changedIDs []string
+
+	err := dbClient.Select(&changedIDs, `
+	select m.instance_id from metrics m
+	left join instance_status s on s.instance_id = m.instance_id
+	left join instance_changes c on c.instance_id = m.instance_id
+	where m.updated_at >= $1 or s.updated_at >= $1 or c.changed_at >= $1
+	`, sqlTime(since))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changed := map[string]bool{}
+	for _, id := range changedIDs {
+		changed[id] = true
+	}
+
+	var silences []Silence
+	err = dbClient.Select(&silences, `
+	select * from silences
+	where created_at >= $1 or (starts_at >= $1 and starts_at <= $2) or (ends_at >= $1 and ends_at <= $2)
+	`, sqlTime(since), sqlTime(time.Now()))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	instances := []Metrics{}
+	for _, m := range metrics {
+		for _, silence := range silences {
+			if silence.matches(m) {
+				changed[m.InstanceID] = true
+			}
+		}
+
+		if changed[m.InstanceID] {
+			instances = append(instances, m)
+		}
+	}
+
+	removed := []string{}
+	err = dbClient.Select(&removed, `
+	select instance_id from removed_instances
+	where removed_at >= $1
+	and instance_id not in (select instance_id from metrics)
+	and instance_id not in (select instance_id from reconciliation where state = $2)
+	order by instance_id
+	`, sqlTime(since), missingAgent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return instances, removed, nil
+}
+
+// getHealthVersion sums up what GET /api/health shows in a few cheap
+// aggregates, which change whenever its response would, so that clients
+// that are up to date are answered before any of the work. Reports and
+// most other writes replace rows, which gives them a new rowid even
+// within the same second.
+func getHealthVersion(dbClient *sqlx.DB, now time.Time) (string, error) {
+	var version string
+
+	err := dbClient.Get(&version, `
+	select
+	  (select count(*) || '/' || coalesce(max(rowid), 0) from metrics) || ' ' ||
+	  (select count(*) || '/' || coalesce(max(rowid), 0) from instance_status) || ' ' ||
+	  (select count(*) || '/' || coalesce(max(rowid), 0) from instance_changes) || ' ' ||
+	  (select count(*) || '/' || coalesce(max(rowid), 0) from removed_instances) || ' ' ||
+	  (select count(*) || '/' || coalesce(max(rowid), 0) from disk_forecasts) || ' ' ||
+	  (select count(*) || '/' || coalesce(sum(rowid), 0) || '/' || coalesce(max(since), '') from reconciliation) || ' ' ||
+	  (select coalesce(group_concat(id), '') from silences where starts_at <= $1 and ends_at > $1)
+	`, sqlTime(now))
+
+	return version, err
+}
+
+// notModified sets the ETag of a response, and answers clients that
+// already hold it with 304 Not Modified, returning true.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if match = strings.TrimSpace(match); match == etag || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+
+	return false
+}
+
+func newETag(s string) string {
+	return fmt.Sprintf(`"%x"`, sha1.Sum([]byte(s)))
+}
+
+// writeJSON encodes v along with an ETag of the encoding, and answers
+// clients that already hold that encoding with 304 Not Modified instead.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	contents, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	contents = append(contents, '\n')
+
+	if notModified(w, r, newETag(string(contents))) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(contents)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aemengo/bosh-deployment-dashboard/config"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"sort"
+)
+
+const quorumSchema = `
+	create table if not exists quorum_status (
+	  deployment text not null,
+	  instance_name text not null,
+	  lost integer not null,
+	  updated_at timestamp default current_timestamp not null,
+	  primary key (deployment, instance_name)
+	);
+	`
+
+const (
+	eventQuorumLost     = "quorum_lost"
+	eventQuorumRestored = "quorum_restored"
+
+	deploymentHealthy    = "healthy"
+	deploymentDegraded   = "degraded"
+	deploymentQuorumLost = "quorum_lost"
+)
+
+type QuorumStatus struct {
+	Expected int  `json:"expected"`
+	Required int  `json:"required"`
+	Lost     bool `json:"lost"`
+}
+
+// DeploymentStatus tells a deployment with a few failing instances apart
+// from one where a clustered instance group lost its quorum.
+type DeploymentStatus struct {
+	Deployment string   `json:"deployment"`
+	Status     string   `json:"status"`
+	Instances  int      `json:"instances"`
+	Healthy    int      `json:"healthy"`
+	Stale      int      `json:"stale"`
+	Failing    int      `json:"failing"`
+	QuorumLost []string `json:"quorum_lost,omitempty"`
+
+	// EarliestDiskFull is the persistent disk forecast to fill up first.
+	EarliestDiskFull *Forecast `json:"earliest_disk_full,omitempty"`
+}
+
+func validateQuorums(quorums []config.Quorum) error {
+	for _, q := range quorums {
+		if q.Deployment == "" || q.InstanceName == "" {
+			return errors.New("quorum policy is missing a deployment or instance_name")
+		}
+
+		if (q.MinHealthy > 0) == q.Majority {
+			return fmt.Errorf("quorum policy for %s/%s needs exactly one of min_healthy or majority", q.Deployment, q.InstanceName)
+		}
+
+		if q.Instances < 0 {
+			return fmt.Errorf("quorum policy for %s/%s has a negative number of instances", q.Deployment, q.InstanceName)
+		}
+	}
+	return nil
+}
+
+// quorumStatus checks an instance group against its quorum policy, if it
+// has one. expected is how many instances the group should have, so that
+// instances that are gone do not shrink the majority.
+func quorumStatus(quorums []config.Quorum, group InstanceGroup, expected int) *QuorumStatus {
+	for _, q := range quorums {
+		if q.Deployment != group.Deployment || q.InstanceName != group.Name {
+			continue
+		}
+
+		if q.Instances > 0 {
+			expected = q.Instances
+		}
+
+		required := q.MinHealthy
+		if q.Majority {
+			required = expected/2 + 1
+		}
+
+		return &QuorumStatus{Expected: expected, Required: required, Lost: group.Healthy < required}
+	}
+
+	return nil
+}
+
+func handleGetDeployments(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, cfg config.Config, logger *log.Logger) {
+	groups, err := getInstanceGroups(dbClient, cfg.Hub.Quorums, "")
+	if err != nil {
+		logger.Printf("Error computing instance groups: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	forecasts, err := getDiskForecasts(dbClient)
+	if err != nil {
+		logger.Printf("Error retrieving disk forecasts from DB: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var instances []struct {
+		InstanceID string `db:"instance_id"`
+		Deployment string `db:"deployment"`
+	}
+
+	if err := dbClient.Select(&instances, "select instance_id, deployment from metrics"); err != nil {
+		logger.Printf("Error retrieving system information from DB: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var (
+		deployments []DeploymentStatus
+		index       = map[string]int{}
+	)
+
+	for _, group := range groups {
+		i, ok := index[group.Deployment]
+		if !ok {
+			i = len(deployments)
+			index[group.Deployment] = i
+			deployments = append(deployments, DeploymentStatus{Deployment: group.Deployment})
+		}
+
+		d := &deployments[i]
+		d.Instances += group.Instances
+		d.Healthy += group.Healthy
+		d.Stale += group.Stale
+		d.Failing += group.Failing
+
+		if group.Quorum != nil && group.Quorum.Lost {
+			d.QuorumLost = append(d.QuorumLost, group.Name)
+		}
+	}
+
+	for _, instance := range instances {
+		f, ok := forecasts[instance.InstanceID]
+		if !ok || f.FullAt == nil {
+			continue
+		}
+
+		d := &deployments[index[instance.Deployment]]
+		if d.EarliestDiskFull == nil || f.FullAt.Before(*d.EarliestDiskFull.FullAt) {
+			d.EarliestDiskFull = &f
+		}
+	}
+
+	for i, d := range deployments {
+		switch {
+		case len(d.QuorumLost) > 0:
+			deployments[i].Status = deploymentQuorumLost
+		case d.Stale > 0 || d.Failing > 0:
+			deployments[i].Status = deploymentDegraded
+		default:
+			deployments[i].Status = deploymentHealthy
+		}
+	}
+
+	sort.Slice(deployments, func(i, j int) bool { return deployments[i].Deployment < deployments[j].Deployment })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deployments)
+}
+
+// evaluateQuorums compares the instance groups with a quorum policy, in
+// the given deployment or in all of them, with their last known state and
+// returns notifications for the groups that lost or regained quorum.
+func evaluateQuorums(dbClient *sqlx.DB, quorums []config.Quorum, deployment string) ([]Notification, error) {
+	if len(quorums) == 0 {
+		return nil, nil
+	}
+
+	groups, err := getInstanceGroups(dbClient, quorums, deployment)
+	if err != nil {
+		return nil, err
+	}
+
+	var notifications []Notification
+	for _, group := range groups {
+		if group.Quorum == nil {
+			continue
+		}
+
+		var previous []bool
+		err := dbClient.Select(&previous, "select lost from quorum_status where deployment = $1 and instance_name = $2", group.Deployment, group.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = dbClient.Exec("insert or replace into quorum_status (deployment, instance_name, lost) values ($1, $2, $3)", group.Deployment, group.Name, group.Quorum.Lost)
+		if err != nil {
+			return nil, err
+		}
+
+		wasLost := len(previous) > 0 && previous[0]
+		if wasLost == group.Quorum.Lost {
+			continue
+		}
+
+		event := Event{
+			Deployment: group.Deployment,
+			Name:       group.Name,
+			Kind:       eventQuorumRestored,
+			Message:    fmt.Sprintf("%d of %d instance(s) healthy, quorum needs %d", group.Healthy, group.Quorum.Expected, group.Quorum.Required),
+		}
+
+		n := newNotification(event, Metrics{Deployment: group.Deployment, Name: group.Name})
+		if group.Quorum.Lost {
+			n.Kind = eventQuorumLost
+			n.Severity = "critical"
+		}
+
+		notifications = append(notifications, n)
+	}
+
+	return notifications, nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/aemengo/bosh-deployment-dashboard/config"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"time"
+)
+
+const reconciliationSchema = `
+	create table if not exists reconciliation (
+	  instance_id text not null primary key,
+	  state text not null,
+	  deployment text not null,
+	  name text not null,
+	  instance_index integer not null,
+	  az text not null,
+	  since timestamp default current_timestamp not null
+	);
+	`
+
+// missingAgent instances are expected by the director but never reported,
+// and orphaned instances report but the director does not know them. The
+// events for new discrepancies are of the same kinds.
+const (
+	missingAgent = "missing_agent"
+	orphaned     = "orphaned"
+)
+
+// Discrepancy is an instance the hub and the BOSH Director disagree on.
+type Discrepancy struct {
+	InstanceID    string    `json:"instance_id" db:"instance_id"`
+	State         string    `json:"state" db:"state"`
+	Deployment    string    `json:"deployment" db:"deployment"`
+	Name          string    `json:"name" db:"name"`
+	InstanceIndex int       `json:"instance_index" db:"instance_index"`
+	AZ            string    `json:"az" db:"az"`
+	Since         time.Time `json:"since" db:"since"`
+}
+
+// metrics stands in for the metrics of an instance whose agent never
+// reported, as last updated when it was found missing.
+func (d Discrepancy) metrics() Metrics {
+	return Metrics{
+		InstanceID:    d.InstanceID,
+		Name:          d.Name,
+		AZ:            d.AZ,
+		Deployment:    d.Deployment,
+		InstanceIndex: d.InstanceIndex,
+		UpdatedAt:     d.Since,
+	}
+}
+
+func handleGetReconciliation(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, logger *log.Logger) {
+	discrepancies := []Discrepancy{}
+
+	err := dbClient.Select(&discrepancies, `
+	select * from reconciliation
+	where $1 = '' or deployment = $1
+	order by deployment, name, instance_index
+	`, r.URL.Query().Get("deployment"))
+	if err != nil {
+		logger.Printf("Error retrieving reconciliation from DB: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(discrepancies)
+}
+
+// runReconciler compares the instances on the director with those that
+// report every interval, starting right away.
+func runReconciler(dbClient *sqlx.DB, cfg config.Config, logger *log.Logger) {
+	client, err := newDirectorClient(cfg.Hub.Director)
+	if err != nil {
+		logger.Printf("Error %s\n", err)
+		return
+	}
+
+	ticker := time.NewTicker(cfg.Hub.Director.Interval)
+
+	for {
+		instances, err := client.getInstances()
+		if err != nil {
+			logger.Printf("Error listing instances on the director: %s\n", err)
+		} else {
+			events, err := reconcile(dbClient, instances)
+			if err != nil {
+				logger.Printf("Error reconciling instances with the director: %s\n", err)
+			}
+
+			writeEvents(dbClient, events, logger)
+		}
+
+		<-ticker.C
+	}
+}
+
+// reconcile records the instances the director and the hub disagree on,
+// and returns events for the new discrepancies. Instances the director
+// keeps no VM for, such as stopped ones, are not expected to report.
+func reconcile(dbClient *sqlx.DB, instances []DirectorInstance) ([]Event, error) {
+	metrics, err := getMetricsFromDB(dbClient)
+	if err != nil {
+		return nil, err
+	}
+
+	var previous []Discrepancy
+	if err := dbClient.Select(&previous, "select * from reconciliation"); err != nil {
+		return nil, err
+	}
+
+	var (
+		current   = map[string]Discrepancy{}
+		reporting = map[string]bool{}
+		known     = map[string]bool{}
+	)
+
+	for _, m := range metrics {
+		reporting[m.InstanceID] = true
+	}
+
+	for _, i := range instances {
+		known[i.ID] = true
+
+		if i.ExpectsVM && !reporting[i.ID] {
+			current[i.ID] = Discrepancy{
+				InstanceID:    i.ID,
+				State:         missingAgent,
+				Deployment:    i.Deployment,
+				Name:          i.Job,
+				InstanceIndex: i.Index,
+				AZ:            i.AZ,
+			}
+		}
+	}
+
+	for _, m := range metrics {
+		if !known[m.InstanceID] {
+			current[m.InstanceID] = Discrepancy{
+				InstanceID:    m.InstanceID,
+				State:         orphaned,
+				Deployment:    m.Deployment,
+				Name:          m.Name,
+				InstanceIndex: m.InstanceIndex,
+				AZ:            m.AZ,
+			}
+		}
+	}
+
+	var events []Event
+
+	for _, p := range previous {
+		if d, ok := current[p.InstanceID]; ok && d.State == p.State {
+			delete(current, p.InstanceID)
+			continue
+		}
+
+		if _, err := dbClient.Exec("delete from reconciliation where instance_id = $1", p.InstanceID); err != nil {
+			return nil, err
+		}
+
+		if p.State == orphaned && reporting[p.InstanceID] {
+			if err := touchInstance(dbClient, p.InstanceID); err != nil {
+				return nil, err
+			}
+		}
+
+		// an instance that reports picks up its status from its report,
+		// while one the director no longer expects is gone for clients
+		// polling for changes
+		if p.State == missingAgent && !reporting[p.InstanceID] {
+			if err := addStatusHistory(dbClient, p.InstanceID, statusRemoved); err != nil {
+				return nil, err
+			}
+
+			if _, err := dbClient.Exec("insert or replace into removed_instances (instance_id) values ($1)", p.InstanceID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, d := range current {
+		_, err := dbClient.Exec(`
+		insert into reconciliation (instance_id, state, deployment, name, instance_index, az)
+		values ($1, $2, $3, $4, $5, $6)
+		`, d.InstanceID, d.State, d.Deployment, d.Name, d.InstanceIndex, d.AZ)
+		if err != nil {
+			return nil, err
+		}
+
+		switch d.State {
+		case missingAgent:
+			if err := addStatusHistory(dbClient, d.InstanceID, missingAgent); err != nil {
+				return nil, err
+			}
+
+			// reports still name the instance once the director drops it
+			if err := recordIdentity(dbClient, d.metrics()); err != nil {
+				return nil, err
+			}
+		case orphaned:
+			if err := touchInstance(dbClient, d.InstanceID); err != nil {
+				return nil, err
+			}
+		}
+
+		message := "the director expects this instance, but its agent never reported"
+		if d.State == orphaned {
+			message = "reporting, but the director does not know this instance"
+		}
+
+		events = append(events, newMetricsEvent(d.metrics(), d.State, message))
+	}
+
+	return events, nil
+}
+
+func getDiscrepancies(dbClient *sqlx.DB) (discrepancies []Discrepancy, err error) {
+	err = dbClient.Select(&discrepancies, "select * from reconciliation order by deployment, name, instance_index")
+	return
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/aemengo/bosh-deployment-dashboard/config"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	overProvisioned  = "over_provisioned"
+	underProvisioned = "under_provisioned"
+	rightSized       = "right_sized"
+	insufficientData = "insufficient_data"
+
+	// instance groups whose p95 CPU or memory is above this need more
+	underProvisionedAbove = 80.0
+
+	// instance groups whose p95 CPU and memory are both below this could
+	// do with less
+	overProvisionedBelow = 30.0
+
+	// suggested sizes put the p95 at this utilization
+	targetUtilization = 60.0
+
+	minRightsizingSamples = 10
+
+	gibibyte = 1 << 30
+)
+
+// Rightsizing recommends a size for an instance group from the 95th
+// percentile of its CPU and memory usage over the report window, taken
+// over the averages of the finest history that reaches back that far,
+// minutes by default. Samples counts the samples of history behind it.
+type Rightsizing struct {
+	Deployment           string  `json:"deployment"`
+	Name                 string  `json:"name"`
+	Instances            int     `json:"instances"`
+	Samples              int     `json:"samples"`
+	CPUCount             int     `json:"cpu_count"`
+	MemoryTotal          uint64  `json:"memory_total"`
+	CPUP95               float64 `json:"cpu_p95"`
+	MemoryP95            float64 `json:"memory_p95"`
+	Recommendation       string  `json:"recommendation"`
+	SuggestedCPUCount    int     `json:"suggested_cpu_count,omitempty"`
+	SuggestedMemoryTotal uint64  `json:"suggested_memory_total,omitempty"`
+}
+
+func handleGetRightsizing(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, cfg config.Config, logger *log.Logger) {
+	query := r.URL.Query()
+	window := cfg.Hub.RightsizingWindow
+
+	if s := query.Get("window"); s != "" {
+		var err error
+		if window, err = time.ParseDuration(s); err != nil {
+			logger.Printf("Error parsing window parameter %q: %s\n", s, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := getRightsizingReport(dbClient, cfg.Hub, query.Get("deployment"), window)
+	if err != nil {
+		logger.Printf("Error building rightsizing report: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if query.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="rightsizing.csv"`)
+		writeRightsizingCSV(w, report)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func getRightsizingReport(dbClient *sqlx.DB, cfg config.Hub, deployment string, window time.Duration) ([]Rightsizing, error) {
+	var metrics []Metrics
+	if err := dbClient.Select(&metrics, "select * from metrics where $1 = '' or deployment = $1", deployment); err != nil {
+		return nil, err
+	}
+
+	var inventory []Inventory
+	if err := dbClient.Select(&inventory, "select * from inventory where $1 = '' or deployment = $1", deployment); err != nil {
+		return nil, err
+	}
+
+	groups, err := getInstanceGroups(dbClient, nil, deployment)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		cpu     = map[[2]string][]weightedValue{}
+		memory  = map[[2]string][]weightedValue{}
+		samples = map[[2]string]int{}
+	)
+
+	now := time.Now()
+
+	// every bucket counts as many times as the samples it stands for, so
+	// that buckets rolled up and raw samples not rolled up yet weigh alike
+	for _, m := range metrics {
+		points, err := getSeriesBuckets(dbClient, cfg.Retention, m.InstanceID, now.Add(-window), now)
+		if err != nil {
+			return nil, err
+		}
+
+		key := [2]string{m.Deployment, m.Name}
+		for _, p := range points {
+			cpu[key] = append(cpu[key], weightedValue{p.Stats["cpu_used"].Avg, p.Samples})
+			memory[key] = append(memory[key], weightedValue{p.Stats["memory_used"].Avg, p.Samples})
+			samples[key] += p.Samples
+		}
+	}
+
+	report := []Rightsizing{}
+
+	for _, group := range groups {
+		key := [2]string{group.Deployment, group.Name}
+
+		r := Rightsizing{
+			Deployment: group.Deployment,
+			Name:       group.Name,
+			Instances:  group.Instances,
+			Samples:    samples[key],
+			CPUP95:     percentile(cpu[key], 95),
+			MemoryP95:  percentile(memory[key], 95),
+		}
+
+		for _, i := range inventory {
+			if i.Deployment == group.Deployment && i.Name == group.Name {
+				if i.CPUCount > r.CPUCount {
+					r.CPUCount = i.CPUCount
+				}
+				if i.MemoryTotal > r.MemoryTotal {
+					r.MemoryTotal = i.MemoryTotal
+				}
+			}
+		}
+
+		switch {
+		case r.Samples < minRightsizingSamples:
+			r.Recommendation = insufficientData
+		case r.CPUP95 > underProvisionedAbove || r.MemoryP95 > underProvisionedAbove:
+			r.Recommendation = underProvisioned
+		case r.CPUP95 < overProvisionedBelow && r.MemoryP95 < overProvisionedBelow:
+			r.Recommendation = overProvisioned
+		default:
+			r.Recommendation = rightSized
+		}
+
+		if r.Recommendation == overProvisioned || r.Recommendation == underProvisioned {
+			if r.CPUCount > 0 {
+				r.SuggestedCPUCount = int(math.Max(1, math.Ceil(float64(r.CPUCount)*r.CPUP95/targetUtilization)))
+			}
+
+			if r.MemoryTotal > 0 {
+				gib := math.Max(1, math.Ceil(float64(r.MemoryTotal)*r.MemoryP95/targetUtilization/gibibyte))
+				r.SuggestedMemoryTotal = uint64(gib) * gibibyte
+			}
+		}
+
+		report = append(report, r)
+	}
+
+	return report, nil
+}
+
+func writeRightsizingCSV(w http.ResponseWriter, report []Rightsizing) {
+	writer := csv.NewWriter(w)
+
+	writer.Write([]string{
+		"deployment",
+		"instance_group",
+		"instances",
+		"samples",
+		"cpu_count",
+		"memory_total",
+		"cpu_p95",
+		"memory_p95",
+		"recommendation",
+		"suggested_cpu_count",
+		"suggested_memory_total",
+	})
+
+	for _, r := range report {
+		writer.Write([]string{
+			r.Deployment,
+			r.Name,
+			strconv.Itoa(r.Instances),
+			strconv.Itoa(r.Samples),
+			strconv.Itoa(r.CPUCount),
+			strconv.FormatUint(r.MemoryTotal, 10),
+			strconv.FormatFloat(r.CPUP95, 'f', 2, 64),
+			strconv.FormatFloat(r.MemoryP95, 'f', 2, 64),
+			r.Recommendation,
+			strconv.Itoa(r.SuggestedCPUCount),
+			strconv.FormatUint(r.SuggestedMemoryTotal, 10),
+		})
+	}
+
+	writer.Flush()
+}
+
+// weightedValue is a value that counts as weight values.
+type weightedValue struct {
+	value  float64
+	weight int
+}
+
+// percentile returns the nearest-rank percentile of the weighted values.
+func percentile(values []weightedValue, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sorted := append([]weightedValue(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].value < sorted[j].value })
+
+	var total int
+	for _, v := range sorted {
+		total += v.weight
+	}
+
+	rank := int(math.Ceil(p / 100 * float64(total)))
+
+	var seen int
+	for _, v := range sorted {
+		seen += v.weight
+		if seen >= rank {
+			return v.value
+		}
+	}
+
+	return sorted[len(sorted)-1].value
+}
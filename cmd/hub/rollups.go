@@ -0,0 +1,383 @@
+package main
+
+import (
+	"database/sql/driver"
+	"github.com/aemengo/bosh-deployment-dashboard/config"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"math"
+	"time"
+)
+
+const rollupsSchema = `
+	create table if not exists history_rollups (
+	  instance_id text not null,
+	  tier text not null,
+	  bucket timestamp not null,
+	  samples integer not null,
+	  stats text not null,
+	  primary key (instance_id, tier, bucket)
+	);
+	`
+
+const (
+	tierRaw    = "raw"
+	tierMinute = "1m"
+	tierHour   = "1h"
+	tierDay    = "1d"
+
+	// history series are cut into about this many points unless a request
+	// asks for another step
+	maxHistoryPoints = 500
+)
+
+// historyTier is raw history, or a rollup of the tier before it into
+// buckets of step. Raw samples arrive about every 10 seconds.
+type historyTier struct {
+	name      string
+	step      time.Duration
+	retention func(config.Retention) time.Duration
+}
+
+// historyTiers go from finest to coarsest.
+var historyTiers = []historyTier{
+	{tierRaw, 10 * time.Second, func(r config.Retention) time.Duration { return r.Raw }},
+	{tierMinute, time.Minute, func(r config.Retention) time.Duration { return r.Minute }},
+	{tierHour, time.Hour, func(r config.Retention) time.Duration { return r.Hour }},
+	{tierDay, 24 * time.Hour, func(r config.Retention) time.Duration { return r.Day }},
+}
+
+// Aggregate summarizes the values of a stat within a bucket of history.
+// StdDev is the spread of the samples around Avg, which rollups made
+// before it was kept leave at zero.
+type Aggregate struct {
+	Min    float64 `json:"min"`
+	Avg    float64 `json:"avg"`
+	Max    float64 `json:"max"`
+	Last   float64 `json:"last"`
+	StdDev float64 `json:"stddev"`
+}
+
+// Aggregates are keyed by stat name.
+type Aggregates map[string]Aggregate
+
+func (a *Aggregates) Scan(src interface{}) error {
+	return scanJSON(src, a)
+}
+
+func (a Aggregates) Value() (driver.Value, error) {
+	return valueJSON(a)
+}
+
+// Point is a step of a history series: a raw sample, or the rollup of the
+// samples within a bucket starting at Time.
+type Point struct {
+	Time    time.Time  `json:"time" db:"bucket"`
+	Samples int        `json:"samples" db:"samples"`
+	Stats   Aggregates `json:"stats" db:"stats"`
+}
+
+func samplePoints(samples []Sample) []Point {
+	points := make([]Point, 0, len(samples))
+
+	for _, s := range samples {
+		p := Point{Time: s.CreatedAt, Samples: 1, Stats: Aggregates{}}
+
+		for _, stat := range statNames {
+			value, _ := statValue(s.metrics(), stat)
+			p.Stats[stat] = Aggregate{Min: value, Avg: value, Max: value, Last: value}
+		}
+
+		points = append(points, p)
+	}
+
+	return points
+}
+
+// sample flattens the point into a sample of the average of each stat.
+func (p Point) sample(instanceID string) Sample {
+	return Sample{
+		InstanceID:         instanceID,
+		CpuUsed:            p.Stats["cpu_used"].Avg,
+		MemoryUsed:         p.Stats["memory_used"].Avg,
+		PersistentDiskUsed: p.Stats["persistent_disk_used"].Avg,
+		Load15:             p.Stats["load_15"].Avg,
+		CreatedAt:          p.Time,
+	}
+}
+
+// rollUp merges points, which must be in time order, into buckets of step.
+func rollUp(points []Point, step time.Duration) []Point {
+	var buckets []Point
+
+	for _, p := range points {
+		bucket := p.Time.Truncate(step)
+
+		if len(buckets) == 0 || !buckets[len(buckets)-1].Time.Equal(bucket) {
+			b := Point{Time: bucket, Samples: p.Samples, Stats: Aggregates{}}
+			for stat, a := range p.Stats {
+				b.Stats[stat] = a
+			}
+			buckets = append(buckets, b)
+			continue
+		}
+
+		b := &buckets[len(buckets)-1]
+		for stat, a := range p.Stats {
+			merged := b.Stats[stat]
+			merged.Min = math.Min(merged.Min, a.Min)
+			merged.Max = math.Max(merged.Max, a.Max)
+			merged.Avg, merged.StdDev = pool(merged.Avg, merged.StdDev, b.Samples, a.Avg, a.StdDev, p.Samples)
+			merged.Last = a.Last
+			b.Stats[stat] = merged
+		}
+		b.Samples += p.Samples
+	}
+
+	return buckets
+}
+
+// pool combines the mean and standard deviation of two sets of n1 and n2
+// samples into those of all of them.
+func pool(mean1 float64, stdDev1 float64, n1 int, mean2 float64, stdDev2 float64, n2 int) (float64, float64) {
+	n := float64(n1 + n2)
+	if n == 0 {
+		return 0, 0
+	}
+
+	mean := (mean1*float64(n1) + mean2*float64(n2)) / n
+	squares := (float64(n1)*(stdDev1*stdDev1+mean1*mean1) + float64(n2)*(stdDev2*stdDev2+mean2*mean2)) / n
+
+	return mean, math.Sqrt(math.Max(0, squares-mean*mean))
+}
+
+// runHistoryRollups rolls history up into the coarser tiers once a minute,
+// starting with whatever accumulated while the hub was down.
+func runHistoryRollups(dbClient *sqlx.DB, logger *log.Logger) {
+	ticker := time.NewTicker(time.Minute)
+
+	for {
+		if err := rollUpHistory(dbClient, time.Now()); err != nil {
+			logger.Printf("Error rolling up history: %s\n", err)
+		}
+
+		<-ticker.C
+	}
+}
+
+// rollUpHistory rolls each tier into the next for the buckets that ended
+// since the last rollup of every instance.
+func rollUpHistory(dbClient *sqlx.DB, now time.Time) error {
+	var instanceIDs []string
+	if err := dbClient.Select(&instanceIDs, "select instance_id from metrics"); err != nil {
+		return err
+	}
+
+	for i := 1; i < len(historyTiers); i++ {
+		tier := historyTiers[i]
+
+		for _, instanceID := range instanceIDs {
+			since, err := rolledUntil(dbClient, tier, instanceID)
+			if err != nil {
+				return err
+			}
+
+			until := now.Truncate(tier.step)
+			if !until.After(since) {
+				continue
+			}
+
+			points, err := getPointsFromDB(dbClient, historyTiers[i-1], instanceID, since, until)
+			if err != nil {
+				return err
+			}
+
+			for _, p := range rollUp(points, tier.step) {
+				_, err := dbClient.Exec(`
+				insert or replace into history_rollups (instance_id, tier, bucket, samples, stats)
+				values ($1, $2, $3, $4, $5)
+				`, instanceID, tier.name, sqlTime(p.Time), p.Samples, p.Stats)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// runHistoryPruner drops raw samples and rollups older than the retention
+// of their tier once an hour.
+func runHistoryPruner(dbClient *sqlx.DB, cfg config.Config, logger *log.Logger) {
+	ticker := time.NewTicker(time.Hour)
+
+	for range ticker.C {
+		now := time.Now()
+
+		for _, tier := range historyTiers {
+			before := sqlTime(now.Add(-tier.retention(cfg.Hub.Retention)))
+
+			var err error
+			if tier.name == tierRaw {
+				_, err = dbClient.Exec("delete from history where created_at < $1", before)
+			} else {
+				_, err = dbClient.Exec("delete from history_rollups where tier = $1 and bucket < $2", tier.name, before)
+			}
+
+			if err != nil {
+				logger.Printf("Error pruning %s history: %s\n", tier.name, err)
+			}
+		}
+	}
+}
+
+// chooseTier picks, among the tiers still holding history as old as from,
+// the one whose step is closest to the requested step. When none reaches
+// back that far it picks the tier kept longest.
+func chooseTier(retention config.Retention, from time.Time, step time.Duration) historyTier {
+	var (
+		now      = time.Now()
+		best     = -1
+		distance float64
+		longest  = historyTiers[0]
+	)
+
+	for i, tier := range historyTiers {
+		if tier.retention(retention) > longest.retention(retention) {
+			longest = tier
+		}
+
+		// a range of exactly the retention, which starts a moment before
+		// now is taken here, still fits in the tier
+		if now.Sub(from).Round(time.Second) > tier.retention(retention) {
+			continue
+		}
+
+		d := math.Abs(math.Log(float64(step) / float64(tier.step)))
+		if best == -1 || d < distance {
+			best, distance = i, d
+		}
+	}
+
+	if best == -1 {
+		return longest
+	}
+
+	return historyTiers[best]
+}
+
+// getSeries returns the history of an instance within [from, to] from the
+// tier. Buckets that the tier has not rolled up yet are filled in from the
+// finer tiers, down to the raw samples.
+func getSeries(dbClient *sqlx.DB, tier historyTier, instanceID string, from time.Time, to time.Time) ([]Point, error) {
+	if tier.name == tierRaw {
+		samples, err := getSamplesFromDB(dbClient, instanceID, from, to)
+		if err != nil {
+			return nil, err
+		}
+
+		return samplePoints(samples), nil
+	}
+
+	points, err := getPointsFromDB(dbClient, tier, instanceID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	until, err := rolledUntil(dbClient, tier, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if until.Before(from) {
+		until = from
+	}
+
+	if until.After(to) {
+		return points, nil
+	}
+
+	for i, t := range historyTiers {
+		if t.name == tier.name {
+			rest, err := getSeries(dbClient, historyTiers[i-1], instanceID, until, to)
+			if err != nil {
+				return nil, err
+			}
+			return append(points, rest...), nil
+		}
+	}
+
+	return points, nil
+}
+
+// getSeriesBuckets returns the history of an instance within [from, to]
+// from the finest tier that still reaches back to from, merged into
+// buckets of its step, so that every point covers the same span whether
+// it was rolled up yet or not.
+func getSeriesBuckets(dbClient *sqlx.DB, retention config.Retention, instanceID string, from time.Time, to time.Time) ([]Point, error) {
+	tier := chooseTier(retention, from, historyTiers[0].step)
+
+	points, err := getSeries(dbClient, tier, instanceID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return rollUp(points, tier.step), nil
+}
+
+// getSeriesSamples returns the history of an instance within [from, to] at
+// the tier best suited to the range, flattened into samples.
+func getSeriesSamples(dbClient *sqlx.DB, retention config.Retention, instanceID string, from time.Time, to time.Time) ([]Sample, error) {
+	tier := chooseTier(retention, from, to.Sub(from)/maxHistoryPoints)
+
+	points, err := getSeries(dbClient, tier, instanceID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]Sample, 0, len(points))
+	for _, p := range points {
+		samples = append(samples, p.sample(instanceID))
+	}
+
+	return samples, nil
+}
+
+// getPointsFromDB returns the stored points of the tier within [from, to).
+func getPointsFromDB(dbClient *sqlx.DB, tier historyTier, instanceID string, from time.Time, to time.Time) ([]Point, error) {
+	if tier.name == tierRaw {
+		var samples []Sample
+		err := dbClient.Select(&samples, `
+		select instance_id, cpu_used, memory_used, persistent_disk_used, load_15, created_at from history
+		where instance_id = $1 and created_at >= $2 and created_at < $3
+		order by created_at
+		`, instanceID, sqlTime(from), sqlTime(to))
+		if err != nil {
+			return nil, err
+		}
+
+		return samplePoints(samples), nil
+	}
+
+	var points []Point
+	err := dbClient.Select(&points, `
+	select bucket, samples, stats from history_rollups
+	where instance_id = $1 and tier = $2 and bucket >= $3 and bucket < $4
+	order by bucket
+	`, instanceID, tier.name, sqlTime(from), sqlTime(to))
+	return points, err
+}
+
+// rolledUntil is when the last bucket the tier rolled up for the instance
+// ended, or the zero time before its first rollup.
+func rolledUntil(dbClient *sqlx.DB, tier historyTier, instanceID string) (time.Time, error) {
+	var buckets []time.Time
+
+	err := dbClient.Select(&buckets, "select bucket from history_rollups where instance_id = $1 and tier = $2 order by bucket desc limit 1", instanceID, tier.name)
+	if err != nil || len(buckets) == 0 {
+		return time.Time{}, err
+	}
+
+	return buckets[0].Add(tier.step), nil
+}
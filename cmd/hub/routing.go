@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aemengo/bosh-deployment-dashboard/config"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var groupByFields = map[string]func(Notification) string{
+	"deployment":    func(n Notification) string { return n.Deployment },
+	"label":         func(n Notification) string { return n.Label },
+	"az":            func(n Notification) string { return n.AZ },
+	"instance_name": func(n Notification) string { return n.Name },
+	"instance_id":   func(n Notification) string { return n.InstanceID },
+	"severity":      func(n Notification) string { return n.Severity },
+	"rule":          func(n Notification) string { return n.Rule },
+	"kind":          func(n Notification) string { return n.Kind },
+}
+
+// route is a config.Route with the settings it inherits from its parents
+// filled in. Its id tells groups of different routes apart.
+type route struct {
+	id             string
+	match          config.RouteMatch
+	receiver       string
+	continues      bool
+	groupBy        []string
+	groupWait      time.Duration
+	repeatInterval time.Duration
+	routes         []route
+}
+
+func (r route) matches(n Notification) bool {
+	return (r.match.Deployment == "" || r.match.Deployment == n.Deployment) &&
+		(r.match.Label == "" || r.match.Label == n.Label) &&
+		(r.match.AZ == "" || r.match.AZ == n.AZ) &&
+		(r.match.InstanceName == "" || r.match.InstanceName == n.Name) &&
+		(r.match.Severity == "" || r.match.Severity == n.Severity)
+}
+
+// find returns the routes that handle the notification: the matching
+// children, walked depth first, or the route itself when none match.
+func (r route) find(n Notification) []route {
+	var found []route
+
+	for _, child := range r.routes {
+		if !child.matches(n) {
+			continue
+		}
+
+		found = append(found, child.find(n)...)
+
+		if !child.continues {
+			break
+		}
+	}
+
+	if len(found) == 0 {
+		return []route{r}
+	}
+
+	return found
+}
+
+type notificationGroup struct {
+	receiver      string
+	notifications []Notification
+}
+
+// router hands notifications to receivers through the routing tree,
+// holding back notifications of routes with a group_wait so that
+// everything arriving in that window goes out together.
+type router struct {
+	root      route
+	receivers map[string]Notifier
+	logger    *log.Logger
+
+	mu     sync.Mutex
+	groups map[string]*notificationGroup
+}
+
+func newRouter(cfg config.Hub, logger *log.Logger) (*router, error) {
+	receivers := map[string]Notifier{}
+
+	for _, receiver := range cfg.Receivers {
+		if receiver.Name == "" {
+			return nil, errors.New("notification receiver is missing a name")
+		}
+
+		if _, ok := receivers[receiver.Name]; ok {
+			return nil, fmt.Errorf("notification receiver %q is defined twice", receiver.Name)
+		}
+
+		var notifier multiNotifier
+		if receiver.Log {
+			notifier = append(notifier, logNotifier{logger: logger})
+		}
+
+		if len(receiver.Email) > 0 {
+			if cfg.Email.Host == "" {
+				return nil, fmt.Errorf("notification receiver %q sends email, but no email host is configured", receiver.Name)
+			}
+
+			email := cfg.Email
+			email.To = receiver.Email
+			email.Routes = nil
+			notifier = append(notifier, emailNotifier{cfg: email})
+		}
+
+		if len(notifier) == 0 {
+			return nil, fmt.Errorf("notification receiver %q has neither email recipients nor log", receiver.Name)
+		}
+
+		// every receiver gets a queue of its own, so that one that is slow
+		// holds up neither the reports of agents nor the other receivers
+		receivers[receiver.Name] = newQueuedNotifier(notifier, logger)
+	}
+
+	parent := route{repeatInterval: cfg.RepeatInterval}
+
+	root, err := buildRoute(cfg.Route, parent, "0", receivers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &router{
+		root:      root,
+		receivers: receivers,
+		logger:    logger,
+		groups:    map[string]*notificationGroup{},
+	}, nil
+}
+
+func buildRoute(cfg config.Route, parent route, id string, receivers map[string]Notifier) (route, error) {
+	r := route{
+		id:             id,
+		match:          cfg.Match,
+		receiver:       cfg.Receiver,
+		continues:      cfg.Continue,
+		groupBy:        cfg.GroupBy,
+		groupWait:      cfg.GroupWait,
+		repeatInterval: cfg.RepeatInterval,
+	}
+
+	if r.receiver == "" {
+		r.receiver = parent.receiver
+	}
+
+	if r.groupBy == nil {
+		r.groupBy = parent.groupBy
+	}
+
+	if r.groupWait == 0 {
+		r.groupWait = parent.groupWait
+	}
+
+	if r.repeatInterval == 0 {
+		r.repeatInterval = parent.repeatInterval
+	}
+
+	if _, ok := receivers[r.receiver]; !ok {
+		return route{}, fmt.Errorf("notification route uses unknown receiver %q", r.receiver)
+	}
+
+	for _, field := range r.groupBy {
+		if _, ok := groupByFields[field]; !ok {
+			return route{}, fmt.Errorf("notification route cannot group by %q", field)
+		}
+	}
+
+	for i, child := range cfg.Routes {
+		childRoute, err := buildRoute(child, r, fmt.Sprintf("%s.%d", id, i), receivers)
+		if err != nil {
+			return route{}, err
+		}
+
+		r.routes = append(r.routes, childRoute)
+	}
+
+	return r, nil
+}
+
+func (r *router) Notify(notifications []Notification) error {
+	var failed []string
+
+	for _, n := range notifications {
+		for _, matched := range r.root.find(n) {
+			if matched.groupWait == 0 {
+				if err := r.receivers[matched.receiver].Notify([]Notification{n}); err != nil {
+					failed = append(failed, fmt.Sprintf("%s: %s", matched.receiver, err))
+				}
+				continue
+			}
+
+			r.addToGroup(matched, n)
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+// addToGroup holds the notification back with the others of its group,
+// sending the group once the route's group_wait has passed.
+func (r *router) addToGroup(matched route, n Notification) {
+	key := matched.id
+	for _, field := range matched.groupBy {
+		key += "\x00" + groupByFields[field](n)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if group, ok := r.groups[key]; ok {
+		group.notifications = append(group.notifications, n)
+		return
+	}
+
+	r.groups[key] = &notificationGroup{receiver: matched.receiver, notifications: []Notification{n}}
+
+	time.AfterFunc(matched.groupWait, func() { r.flush(key) })
+}
+
+func (r *router) flush(key string) {
+	r.mu.Lock()
+	group := r.groups[key]
+	delete(r.groups, key)
+	r.mu.Unlock()
+
+	if err := r.receivers[group.receiver].Notify(group.notifications); err != nil {
+		r.logger.Printf("Error sending %d grouped notification(s) to %s: %s\n", len(group.notifications), group.receiver, err)
+	}
+}
+
+// repeatInterval is the shortest repeat interval of the routes handling
+// the notification, so that no receiver waits longer than it asked for.
+func (r *router) repeatInterval(n Notification) time.Duration {
+	var interval time.Duration
+
+	for _, matched := range r.root.find(n) {
+		if matched.repeatInterval > 0 && (interval == 0 || matched.repeatInterval < interval) {
+			interval = matched.repeatInterval
+		}
+	}
+
+	return interval
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const silencesSchema = `
+	create table if not exists silences (
+	  id integer not null primary key,
+	  deployment text not null default '',
+	  label text not null default '',
+	  instance_name text not null default '',
+	  az text not null default '',
+	  reason text not null,
+	  created_by text not null default '',
+	  starts_at timestamp not null,
+	  ends_at timestamp not null,
+	  created_at timestamp default current_timestamp not null
+	);
+	`
+
+// Silence suppresses notifications for the instances it matches while it
+// is active. Empty matchers match everything, but at least one is required.
+type Silence struct {
+	ID           int       `json:"id" db:"id"`
+	Deployment   string    `json:"deployment,omitempty" db:"deployment"`
+	Label        string    `json:"label,omitempty" db:"label"`
+	InstanceName string    `json:"instance_name,omitempty" db:"instance_name"`
+	AZ           string    `json:"az,omitempty" db:"az"`
+	Reason       string    `json:"reason" db:"reason"`
+	CreatedBy    string    `json:"created_by,omitempty" db:"created_by"`
+	StartsAt     time.Time `json:"starts_at" db:"starts_at"`
+	EndsAt       time.Time `json:"ends_at" db:"ends_at"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
+
+func (s Silence) matches(metrics Metrics) bool {
+	return (s.Deployment == "" || s.Deployment == metrics.Deployment) &&
+		(s.Label == "" || s.Label == metrics.Label) &&
+		(s.InstanceName == "" || s.InstanceName == metrics.Name) &&
+		(s.AZ == "" || s.AZ == metrics.AZ)
+}
+
+func handleGetSilences(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, logger *log.Logger) {
+	var (
+		silences []Silence
+		err      error
+	)
+
+	if r.URL.Query().Get("active") == "true" {
+		silences, err = getActiveSilences(dbClient, time.Now())
+	} else {
+		err = dbClient.Select(&silences, "select * from silences order by starts_at desc")
+	}
+
+	if err != nil {
+		logger.Printf("Error retrieving silences from DB: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(silences)
+}
+
+func handlePostSilence(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, logger *log.Logger) {
+	var s Silence
+
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		logger.Printf("Error reading json body of request: %s\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if s.Deployment == "" && s.Label == "" && s.InstanceName == "" && s.AZ == "" {
+		logger.Printf("Error silence needs at least one of deployment, label, instance_name or az\n")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if s.Reason == "" || s.EndsAt.IsZero() {
+		logger.Printf("Error silence is missing a reason or end time\n")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if s.StartsAt.IsZero() {
+		s.StartsAt = time.Now()
+	}
+
+	if !s.EndsAt.After(s.StartsAt) {
+		logger.Printf("Error silence ends before it starts\n")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id, err := writeSilenceToDB(dbClient, s)
+	if err != nil {
+		logger.Printf("Error writing silence to db: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := dbClient.Get(&s, "select * from silences where id = $1", id); err != nil {
+		logger.Printf("Error retrieving silence %d from DB: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// handleDeleteSilence expires a silence right away, keeping it around as
+// a record of the maintenance window.
+func handleDeleteSilence(w http.ResponseWriter, r *http.Request, dbClient *sqlx.DB, logger *log.Logger) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/silences/"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	result, err := dbClient.Exec("update silences set ends_at = $1 where id = $2 and ends_at > $1", sqlTime(time.Now()), id)
+	if err != nil {
+		logger.Printf("Error expiring silence %d: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if count, _ := result.RowsAffected(); count == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("success"))
+}
+
+func getActiveSilences(dbClient *sqlx.DB, at time.Time) (silences []Silence, err error) {
+	err = dbClient.Select(&silences, "select * from silences where starts_at <= $1 and ends_at > $1 order by id", sqlTime(at))
+	return
+}
+
+func getMatchingSilences(dbClient *sqlx.DB, metrics Metrics, at time.Time) ([]Silence, error) {
+	silences, err := getActiveSilences(dbClient, at)
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []Silence
+	for _, s := range silences {
+		if s.matches(metrics) {
+			matching = append(matching, s)
+		}
+	}
+
+	return matching, nil
+}
+
+func writeSilenceToDB(dbClient *sqlx.DB, s Silence) (int64, error) {
+	result, err := dbClient.Exec(`
+	insert into silences (
+	  deployment,
+	  label,
+	  instance_name,
+	  az,
+	  reason,
+	  created_by,
+	  starts_at,
+	  ends_at
+	) VALUES (
+	  $1,
+	  $2,
+	  $3,
+	  $4,
+	  $5,
+	  $6,
+	  $7,
+	  $8
+	  )
+	`,
+		s.Deployment,
+		s.Label,
+		s.InstanceName,
+		s.AZ,
+		s.Reason,
+		s.CreatedBy,
+		sqlTime(s.StartsAt),
+		sqlTime(s.EndsAt),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
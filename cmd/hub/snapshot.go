@@ -0,0 +1,218 @@
+package main
+
+import (
+	"github.com/aemengo/bosh-deployment-dashboard/config"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+const identitySchema = `
+	create table if not exists identity_history (
+	  id integer not null primary key,
+	  instance_id text not null,
+	  name text not null,
+	  address text not null,
+	  az text not null,
+	  deployment text not null,
+	  instance_index integer not null,
+	  ip text not null,
+	  label text not null,
+	  source text not null,
+	  started_at timestamp default current_timestamp not null
+	);
+
+	create index if not exists identity_history_instance_id_started_at on identity_history (instance_id, started_at);
+	`
+
+// identity is what an instance reports about itself, apart from its stats.
+type identity struct {
+	InstanceID    string    `db:"instance_id"`
+	Name          string    `db:"name"`
+	Address       string    `db:"address"`
+	AZ            string    `db:"az"`
+	Deployment    string    `db:"deployment"`
+	InstanceIndex int       `db:"instance_index"`
+	IP            string    `db:"ip"`
+	Label         string    `db:"label"`
+	Source        string    `db:"source"`
+	StartedAt     time.Time `db:"started_at"`
+}
+
+func (i identity) metrics() Metrics {
+	return Metrics{
+		InstanceID:    i.InstanceID,
+		Name:          i.Name,
+		Address:       i.Address,
+		AZ:            i.AZ,
+		Deployment:    i.Deployment,
+		InstanceIndex: i.InstanceIndex,
+		IP:            i.IP,
+		Label:         i.Label,
+		Vitals:        Vitals{Source: i.Source},
+	}
+}
+
+// recordIdentity keeps every change in the identity of an instance, so
+// that snapshots show instances as they were, even once removed.
+func recordIdentity(dbClient *sqlx.DB, m Metrics) error {
+	_, err := dbClient.Exec(`
+	insert into identity_history (instance_id, name, address, az, deployment, instance_index, ip, label, source)
+	select $1, $2, $3, $4, $5, $6, $7, $8, $9
+	where not exists (
+	  select 1 from identity_history
+	  where id = (select max(id) from identity_history where instance_id = $1)
+	  and name = $2 and address = $3 and az = $4 and deployment = $5
+	  and instance_index = $6 and ip = $7 and label = $8 and source = $9
+	)
+	`, m.InstanceID, m.Name, m.Address, m.AZ, m.Deployment, m.InstanceIndex, m.IP, m.Label, m.Source)
+	return err
+}
+
+// migrateIdentityHistory starts the identity history of instances that
+// reported before the hub kept one, from their first sample.
+func migrateIdentityHistory(dbClient *sqlx.DB) error {
+	_, err := dbClient.Exec(`
+	insert into identity_history (instance_id, name, address, az, deployment, instance_index, ip, label, source, started_at)
+	select instance_id, coalesce(name, ''), coalesce(address, ''), coalesce(az, ''), coalesce(deployment, ''),
+	  coalesce(instance_index, 0), coalesce(ip, ''), coalesce(label, ''), source,
+	  coalesce((select min(created_at) from history h where h.instance_id = metrics.instance_id), updated_at)
+	from metrics
+	where instance_id not in (select instance_id from identity_history)
+	`)
+	return err
+}
+
+// getSnapshot reconstructs the fleet as it looked at a point in time from
+// the history of the hub: the last stats every instance reported by then,
+// who it said it was, the status it had and the silences that were
+// active. Instances the hub first heard of later, or had removed by then,
+// are left out. An instance whose last report is older than staleAfter at
+// that time counts as stale, even if the sweeper had not marked it yet.
+func getSnapshot(dbClient *sqlx.DB, cfg config.Hub, at time.Time) ([]Metrics, error) {
+	var identities []identity
+
+	// the identity each instance had at the time, or the first one it
+	// had for samples from before the hub kept identities
+	err := dbClient.Select(&identities, `
+	select instance_id, name, address, az, deployment, instance_index, ip, label, source, started_at from identity_history
+	where id in (
+	  select coalesce(
+	    (select max(id) from identity_history h where h.instance_id = i.instance_id and h.started_at <= $1),
+	    min(id)
+	  ) from identity_history i group by instance_id
+	)
+	order by deployment, name, instance_index
+	`, sqlTime(at))
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []struct {
+		InstanceID string `db:"instance_id"`
+		Status     string `db:"status"`
+	}
+
+	err = dbClient.Select(&statuses, `
+	select instance_id, status from status_history
+	where id in (select max(id) from status_history where started_at <= $1 group by instance_id)
+	`, sqlTime(at))
+	if err != nil {
+		return nil, err
+	}
+
+	statusAt := map[string]string{}
+	for _, s := range statuses {
+		statusAt[s.InstanceID] = s.Status
+	}
+
+	silences, err := getActiveSilences(dbClient, at)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := []Metrics{}
+
+	for _, i := range identities {
+		if statusAt[i.InstanceID] == statusRemoved {
+			continue
+		}
+
+		point, ok, err := getPointAt(dbClient, i.InstanceID, at)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		m := i.metrics()
+		m.CpuUsed = point.Stats["cpu_used"].Last
+		m.MemoryUsed = point.Stats["memory_used"].Last
+		m.PersistentDiskUsed = point.Stats["persistent_disk_used"].Last
+		m.Load15 = point.Stats["load_15"].Last
+		m.UpdatedAt = point.Time
+
+		staleAfter := cfg.StaleAfter
+		if m.Source == sourceDirector {
+			staleAfter = vitalsStaleAfter(cfg)
+		}
+
+		m.Status = statusAt[m.InstanceID]
+		if point.Time.Before(at.Add(-staleAfter)) {
+			m.Status = statusStale
+		}
+
+		for _, silence := range silences {
+			if silence.matches(m) {
+				m.Silences = append(m.Silences, silence)
+			}
+		}
+
+		snapshot = append(snapshot, m)
+	}
+
+	return snapshot, nil
+}
+
+// getPointAt returns the last point of the history of an instance at or
+// before at, from the finest tier that still holds one. A rollup only
+// counts once its bucket ended by then, and stands for its last values
+// at the end of the bucket.
+func getPointAt(dbClient *sqlx.DB, instanceID string, at time.Time) (Point, bool, error) {
+	var samples []Sample
+
+	err := dbClient.Select(&samples, `
+	select instance_id, cpu_used, memory_used, persistent_disk_used, load_15, created_at from history
+	where instance_id = $1 and created_at <= $2
+	order by created_at desc limit 1
+	`, instanceID, sqlTime(at))
+	if err != nil {
+		return Point{}, false, err
+	}
+
+	if len(samples) > 0 {
+		return samplePoints(samples)[0], true, nil
+	}
+
+	for _, tier := range historyTiers[1:] {
+		var points []Point
+
+		err := dbClient.Select(&points, `
+		select bucket, samples, stats from history_rollups
+		where instance_id = $1 and tier = $2 and bucket <= $3
+		order by bucket desc limit 1
+		`, instanceID, tier.name, sqlTime(at.Add(-tier.step)))
+		if err != nil {
+			return Point{}, false, err
+		}
+
+		if len(points) > 0 {
+			p := points[0]
+			p.Time = p.Time.Add(tier.step)
+			return p, true, nil
+		}
+	}
+
+	return Point{}, false, nil
+}
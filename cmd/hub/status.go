@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/aemengo/bosh-deployment-dashboard/config"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"time"
+)
+
+const statusSchema = `
+	create table if not exists instance_status (
+	  instance_id text not null primary key,
+	  status text not null,
+	  updated_at timestamp default current_timestamp not null
+	);
+
+	create table if not exists status_history (
+	  id integer not null primary key,
+	  instance_id text not null,
+	  status text not null,
+	  started_at timestamp default current_timestamp not null
+	);
+
+	create index if not exists status_history_instance_id_started_at on status_history (instance_id, started_at);
+	`
+
+const (
+	statusHealthy = "healthy"
+	statusFailing = "failing"
+	statusStale   = "stale"
+
+	// statusRemoved only ends the status history of an instance the hub
+	// stopped tracking
+	statusRemoved = "removed"
+)
+
+// evaluateStatus works out the status of an instance that just reported and
+// returns the events for any transition from its previous status. Besides
+// firing alerts, a process state other than running, which the director
+// keeps for agentless instances, makes it failing.
+func evaluateStatus(dbClient *sqlx.DB, metrics Metrics) ([]Event, error) {
+	previous, err := getInstanceStatus(dbClient, metrics.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	var firing int
+	err = dbClient.Get(&firing, "select count(*) from alerts where instance_id = $1 and state = $2", metrics.InstanceID, alertFiring)
+	if err != nil {
+		return nil, err
+	}
+
+	status := statusHealthy
+	if firing > 0 || (metrics.ProcessState != "" && metrics.ProcessState != "running") {
+		status = statusFailing
+	}
+
+	if err := setInstanceStatus(dbClient, metrics.InstanceID, status); err != nil {
+		return nil, err
+	}
+
+	switch previous {
+	case "", status:
+		return nil, nil
+	case statusStale:
+		return []Event{newMetricsEvent(metrics, eventCameBack, "reporting again, now "+status)}, nil
+	default:
+		return []Event{newMetricsEvent(metrics, eventStatusChanged, previous+" -> "+status)}, nil
+	}
+}
+
+// sweepStaleInstances marks instances that have not reported within
+// staleAfter as stale, or within directorStaleAfter for instances pulled
+// from the director.
+func sweepStaleInstances(dbClient *sqlx.DB, staleAfter time.Duration, directorStaleAfter time.Duration) ([]Notification, error) {
+	var (
+		metrics []Metrics
+		now     = time.Now()
+	)
+
+	err := dbClient.Select(&metrics, `
+	select m.* from metrics m
+	left join instance_status s on s.instance_id = m.instance_id
+	where coalesce(s.status, '') != $1
+	and ((m.source != $2 and m.updated_at < $3) or (m.source = $2 and m.updated_at < $4))
+	`, statusStale, sourceDirector, sqlTime(now.Add(-staleAfter)), sqlTime(now.Add(-directorStaleAfter)))
+	if err != nil {
+		return nil, err
+	}
+
+	var notifications []Notification
+	for _, m := range metrics {
+		if err := setInstanceStatus(dbClient, m.InstanceID, statusStale); err != nil {
+			return nil, err
+		}
+
+		after := staleAfter
+		if m.Source == sourceDirector {
+			after = directorStaleAfter
+		}
+
+		event := newMetricsEvent(m, eventWentStale, fmt.Sprintf("no report for more than %s", after))
+		notifications = append(notifications, newNotification(event, m))
+	}
+
+	return notifications, nil
+}
+
+func runStaleSweeper(dbClient *sqlx.DB, cfg config.Config, notifier Notifier, logger *log.Logger) {
+	ticker := time.NewTicker(cfg.Hub.StaleAfter / 2)
+
+	for range ticker.C {
+		notifications, err := sweepStaleInstances(dbClient, cfg.Hub.StaleAfter, vitalsStaleAfter(cfg.Hub))
+		if err != nil {
+			logger.Printf("Error sweeping stale instances: %s\n", err)
+			continue
+		}
+
+		if cfg.Hub.PruneAfter > 0 {
+			if err := pruneMissingInstances(dbClient, cfg.Hub.PruneAfter, logger); err != nil {
+				logger.Printf("Error pruning missing instances: %s\n", err)
+			}
+		}
+
+		quorumNotifications, err := evaluateQuorums(dbClient, cfg.Hub.Quorums, "")
+		if err != nil {
+			logger.Printf("Error evaluating quorums: %s\n", err)
+		}
+
+		notifications = append(notifications, quorumNotifications...)
+
+		var events []Event
+		for _, n := range notifications {
+			events = append(events, n.Event)
+		}
+
+		writeEvents(dbClient, events, logger)
+
+		incidentEvents, incidentNotifications, err := correlateIncidents(dbClient, cfg.Hub.Incidents)
+		if err != nil {
+			logger.Printf("Error correlating incidents: %s\n", err)
+		}
+
+		writeEvents(dbClient, incidentEvents, logger)
+		sendNotifications(dbClient, notifier, append(notifications, incidentNotifications...), logger)
+	}
+}
+
+func getInstanceStatus(dbClient *sqlx.DB, instanceID string) (string, error) {
+	var status string
+
+	err := dbClient.Get(&status, "select status from instance_status where instance_id = $1", instanceID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return status, err
+}
+
+func getStatusesFromDB(dbClient *sqlx.DB) (map[string]string, error) {
+	var rows []struct {
+		InstanceID string `db:"instance_id"`
+		Status     string `db:"status"`
+	}
+
+	if err := dbClient.Select(&rows, "select instance_id, status from instance_status"); err != nil {
+		return nil, err
+	}
+
+	statuses := map[string]string{}
+	for _, row := range rows {
+		statuses[row.InstanceID] = row.Status
+	}
+
+	return statuses, nil
+}
+
+// setInstanceStatus records the status of an instance, keeping every
+// change in its status history.
+func setInstanceStatus(dbClient *sqlx.DB, instanceID string, status string) error {
+	_, err := dbClient.Exec(`
+	insert into status_history (instance_id, status)
+	select $1, $2 where coalesce((select status from instance_status where instance_id = $1), '') != $2
+	`, instanceID, status)
+	if err != nil {
+		return err
+	}
+
+	_, err = dbClient.Exec("insert or replace into instance_status (instance_id, status) values ($1, $2)", instanceID, status)
+	return err
+}
+
+// addStatusHistory records a change in the status of an instance the hub
+// keeps no live status for, such as one whose agent never reported.
+func addStatusHistory(dbClient *sqlx.DB, instanceID string, status string) error {
+	_, err := dbClient.Exec("insert into status_history (instance_id, status) values ($1, $2)", instanceID, status)
+	return err
+}
+
+// migrateStatusHistory starts the status history of instances that got
+// their status before the hub kept one.
+func migrateStatusHistory(dbClient *sqlx.DB) error {
+	_, err := dbClient.Exec(`
+	insert into status_history (instance_id, status, started_at)
+	select instance_id, status, updated_at from instance_status
+	where instance_id not in (select instance_id from status_history)
+	`)
+	return err
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/aemengo/bosh-deployment-dashboard/config"
+	"github.com/aemengo/bosh-deployment-dashboard/info"
+	"github.com/jmoiron/sqlx"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	sourceAgent    = "agent"
+	sourceDirector = "director"
+
+	// instances pulled from the director go stale after missing this
+	// many polls, rather than after stale_after
+	missedVitalsPolls = 3
+)
+
+type Process struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+}
+
+type Processes []Process
+
+func (p *Processes) Scan(src interface{}) error {
+	return scanJSON(src, p)
+}
+
+func (p Processes) Value() (driver.Value, error) {
+	return valueJSON(p)
+}
+
+// Vitals tell where the stats of an instance come from, along with the
+// stats only the BOSH Director keeps, which agents do not report.
+type Vitals struct {
+	Source            string    `json:"source" db:"source"`
+	SwapUsed          float64   `json:"swap_used,omitempty" db:"swap_used"`
+	SystemDiskUsed    float64   `json:"system_disk_used,omitempty" db:"system_disk_used"`
+	EphemeralDiskUsed float64   `json:"ephemeral_disk_used,omitempty" db:"ephemeral_disk_used"`
+	ProcessState      string    `json:"process_state,omitempty" db:"process_state"`
+	Processes         Processes `json:"processes,omitempty" db:"processes"`
+}
+
+// directorVitals is an instance in the result of a director task listing
+// the instances of a deployment in full, with its stats as strings.
+type directorVitals struct {
+	ID           string   `json:"id"`
+	JobName      string   `json:"job_name"`
+	Index        int      `json:"index"`
+	AZ           string   `json:"az"`
+	IPs          []string `json:"ips"`
+	ProcessState string   `json:"process_state"`
+	Processes    []struct {
+		Name  string `json:"name"`
+		State string `json:"state"`
+	} `json:"processes"`
+	Vitals *struct {
+		CPU struct {
+			Sys  string `json:"sys"`
+			User string `json:"user"`
+			Wait string `json:"wait"`
+		} `json:"cpu"`
+		Mem struct {
+			Percent string `json:"percent"`
+		} `json:"mem"`
+		Swap struct {
+			Percent string `json:"percent"`
+		} `json:"swap"`
+		Load []string `json:"load"`
+		Disk map[string]struct {
+			Percent string `json:"percent"`
+		} `json:"disk"`
+		Uptime struct {
+			Secs uint64 `json:"secs"`
+		} `json:"uptime"`
+	} `json:"vitals"`
+}
+
+// health maps the vitals onto what an agent on the instance would report,
+// plus the vitals agents do not report.
+func (d directorVitals) health(deployment string) (info.Info, Vitals) {
+	v := d.Vitals
+
+	i := info.Info{
+		Spec: config.Spec{
+			ID:           d.ID,
+			InstanceName: d.JobName,
+			Index:        d.Index,
+			AZ:           d.AZ,
+			Deployment:   deployment,
+		},
+	}
+
+	if len(d.IPs) > 0 {
+		i.Spec.IP = d.IPs[0]
+	}
+
+	i.Stats.CpuUsed = parsePercent(v.CPU.Sys) + parsePercent(v.CPU.User) + parsePercent(v.CPU.Wait)
+	i.Stats.MemoryUsed = parsePercent(v.Mem.Percent)
+	i.Stats.PersistentDiskUsed = parsePercent(v.Disk["persistent"].Percent)
+	i.Stats.Uptime = v.Uptime.Secs
+
+	if len(v.Load) == 3 {
+		i.Stats.Load15 = parsePercent(v.Load[2])
+	}
+
+	vitals := Vitals{
+		Source:            sourceDirector,
+		SwapUsed:          parsePercent(v.Swap.Percent),
+		SystemDiskUsed:    parsePercent(v.Disk["system"].Percent),
+		EphemeralDiskUsed: parsePercent(v.Disk["ephemeral"].Percent),
+		ProcessState:      d.ProcessState,
+		Processes:         Processes{},
+	}
+
+	for _, p := range d.Processes {
+		vitals.Processes = append(vitals.Processes, Process{Name: p.Name, State: p.State})
+	}
+
+	return i, vitals
+}
+
+// parsePercent reads a stat of the director, which are strings, leaving
+// out the ones it could not measure.
+func parsePercent(s string) float64 {
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+// migrateMetricsForVitals adds the columns for instances pulled from the
+// director to a metrics table created before the hub pulled any.
+func migrateMetricsForVitals(dbClient *sqlx.DB) error {
+	columns := []struct{ name, definition string }{
+		{"source", "text not null default '" + sourceAgent + "'"},
+		{"swap_used", "real not null default 0"},
+		{"system_disk_used", "real not null default 0"},
+		{"ephemeral_disk_used", "real not null default 0"},
+		{"process_state", "text not null default ''"},
+		{"processes", "text not null default '[]'"},
+	}
+
+	for _, c := range columns {
+		if err := addColumn(dbClient, "metrics", c.name, c.definition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getVitals lists the instances of a deployment with their vitals. The
+// director gathers them from the VMs in a task.
+func (c *directorClient) getVitals(deployment string) ([]directorVitals, error) {
+	result, err := c.runTask("/deployments/" + url.PathEscape(deployment) + "/instances?format=full")
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []directorVitals
+
+	decoder := json.NewDecoder(bytes.NewReader(result))
+	for {
+		var d directorVitals
+		if err := decoder.Decode(&d); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		instances = append(instances, d)
+	}
+
+	return instances, nil
+}
+
+// runVitalsPoller records the vitals of the instances of the agentless
+// deployments like reports of agents, every vitals interval. Instances
+// whose agent reports after all are left to their agent. A deployment is
+// skipped while its previous task is still running on the director.
+func runVitalsPoller(dbClient *sqlx.DB, cfg config.Config, notifier Notifier, logger *log.Logger) {
+	client, err := newDirectorClient(cfg.Hub.Director)
+	if err != nil {
+		logger.Printf("Error %s\n", err)
+		return
+	}
+
+	ticker := time.NewTicker(cfg.Hub.Director.VitalsInterval)
+
+	for {
+		for _, deployment := range cfg.Hub.Director.Agentless {
+			instances, err := client.getVitals(deployment)
+			if err == errTaskRunning {
+				logger.Printf("Skipping vitals of %s: %s\n", deployment, err)
+				continue
+			} else if err != nil {
+				logger.Printf("Error retrieving vitals of %s from the director: %s\n", deployment, err)
+				continue
+			}
+
+			var agents []string
+			err = dbClient.Select(&agents, "select instance_id from metrics where deployment = $1 and source = $2 and updated_at >= $3",
+				deployment, sourceAgent, sqlTime(time.Now().Add(-cfg.Hub.StaleAfter)))
+			if err != nil {
+				logger.Printf("Error retrieving instances of %s from DB: %s\n", deployment, err)
+				continue
+			}
+
+			reporting := map[string]bool{}
+			for _, id := range agents {
+				reporting[id] = true
+			}
+
+			for _, d := range instances {
+				if d.Vitals == nil || reporting[d.ID] {
+					continue
+				}
+
+				i, vitals := d.health(deployment)
+				if err := recordHealth(dbClient, cfg, notifier, i, vitals, logger); err != nil {
+					logger.Printf("Error writing system information to db for %s: %s\n", d.ID, err)
+				}
+			}
+		}
+
+		// a poll that outlasted the interval is followed by a full
+		// interval, rather than by another poll straight away
+		select {
+		case <-ticker.C:
+		default:
+		}
+
+		<-ticker.C
+	}
+}
+
+// vitalsStaleAfter is how long instances pulled from the director go
+// without an update before they are stale.
+func vitalsStaleAfter(cfg config.Hub) time.Duration {
+	if d := missedVitalsPolls * cfg.Director.VitalsInterval; d > cfg.StaleAfter {
+		return d
+	}
+	return cfg.StaleAfter
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"time"
 )
 
 type Spec struct {
@@ -16,17 +17,217 @@ type Spec struct {
 	IP           string `yaml:"ip" json:"ip"`
 }
 
+// AlertRule fires for an instance whenever the named stat (cpu_used,
+// memory_used, persistent_disk_used or load_15) is above the threshold.
+// Rules of type "outlier" instead fire when the stat is far above the
+// median of the instance group, with Threshold as the outlier score
+// (3.5 by default), rules of type "forecast" when the stat's trend
+// predicts it reaches 100 within Within, and rules of type "baseline" when
+// the stat is more than Threshold standard deviations above its usual
+// value at this hour of the day. Deployment and Label optionally restrict
+// the instances it applies to.
+type AlertRule struct {
+	Name       string  `yaml:"name"`
+	Type       string  `yaml:"type"`
+	Stat       string  `yaml:"stat"`
+	Threshold  float64 `yaml:"threshold"`
+	Severity   string  `yaml:"severity"`
+	Deployment string  `yaml:"deployment"`
+	Label      string  `yaml:"label"`
+
+	Within time.Duration `yaml:"within"`
+}
+
+// EmailRoute sends notifications about instances matching Deployment and
+// Label (empty matches everything) to its own recipients.
+type EmailRoute struct {
+	Deployment string   `yaml:"deployment"`
+	Label      string   `yaml:"label"`
+	To         []string `yaml:"to"`
+}
+
+// Email configures the SMTP notifier. Notifications go to the recipients
+// of the first matching route, or To when none match. When DigestAt is set
+// (e.g. "08:00", hub local time) a daily digest of the fleet status per
+// deployment is sent as well.
+type Email struct {
+	Host     string       `yaml:"host"`
+	Port     string       `yaml:"port"`
+	StartTLS bool         `yaml:"starttls"`
+	Username string       `yaml:"username"`
+	Password string       `yaml:"password"`
+	From     string       `yaml:"from"`
+	To       []string     `yaml:"to"`
+	Routes   []EmailRoute `yaml:"routes"`
+	DigestAt string       `yaml:"digest_at"`
+}
+
+// Receiver is a named notification target for the routing tree: a list of
+// email recipients (sent through the hub's SMTP settings), the hub log, or
+// both.
+type Receiver struct {
+	Name  string   `yaml:"name"`
+	Email []string `yaml:"email"`
+	Log   bool     `yaml:"log"`
+}
+
+// RouteMatch selects notifications by exact value. Empty fields match
+// everything.
+type RouteMatch struct {
+	Deployment   string `yaml:"deployment"`
+	Label        string `yaml:"label"`
+	AZ           string `yaml:"az"`
+	InstanceName string `yaml:"instance_name"`
+	Severity     string `yaml:"severity"`
+}
+
+// Route is a node of the notification routing tree. A notification goes to
+// the first matching child route, and on to later siblings as long as the
+// matching routes set Continue; when no child matches, the route's own
+// receiver gets it. Unset receivers, grouping and repeat intervals are
+// inherited from the parent route.
+type Route struct {
+	Match          RouteMatch    `yaml:"match"`
+	Receiver       string        `yaml:"receiver"`
+	Continue       bool          `yaml:"continue"`
+	GroupBy        []string      `yaml:"group_by"`
+	GroupWait      time.Duration `yaml:"group_wait"`
+	RepeatInterval time.Duration `yaml:"repeat_interval"`
+	Routes         []Route       `yaml:"routes"`
+}
+
 type Hub struct {
-	IP      string `yaml:"ip"`
-	Port    string `yaml:"port"`
-	DataDir string `yaml:"data_dir"`
-	WebDir  string `yaml:"web_dir"`
+	IP         string        `yaml:"ip"`
+	Port       string        `yaml:"port"`
+	DataDir    string        `yaml:"data_dir"`
+	WebDir     string        `yaml:"web_dir"`
+	StaleAfter time.Duration `yaml:"stale_after"`
+	Alerts     []AlertRule   `yaml:"alerts"`
+
+	// PruneAfter removes instances that have not reported for that long,
+	// such as VMs of a deleted deployment. Zero keeps them forever.
+	PruneAfter time.Duration `yaml:"prune_after"`
+
+	// RepeatInterval re-sends notifications for alerts that are still
+	// firing and nobody acknowledged. Zero disables repeats.
+	RepeatInterval time.Duration `yaml:"repeat_interval"`
+
+	Email Email `yaml:"email"`
+
+	// Receivers and Route replace the default of notifying the log and
+	// every email recipient once a root route receiver is configured.
+	Receivers []Receiver `yaml:"receivers"`
+	Route     Route      `yaml:"route"`
+
+	Flapping  Flapping  `yaml:"flapping"`
+	Incidents Incidents `yaml:"incidents"`
+	Quorums   []Quorum  `yaml:"quorums"`
+
+	// Retention is how long reported stats and their rollups are kept, and
+	// ForecastLookback how much of that history trends are fitted to.
+	Retention        Retention     `yaml:"retention"`
+	ForecastLookback time.Duration `yaml:"forecast_lookback"`
+
+	Baseline Baseline `yaml:"baseline"`
+
+	// RightsizingWindow is how much history the rightsizing report looks
+	// at unless a request asks for another window.
+	RightsizingWindow time.Duration `yaml:"rightsizing_window"`
+
+	SLOs []SLO `yaml:"slos"`
+
+	Director Director `yaml:"director"`
+}
+
+// Director lets the hub compare the instances that report with those the
+// BOSH Director expects, every Interval (5 minutes by default). The hub
+// authenticates as a UAA client, and trusts CACert on top of the system
+// certificates. Reconciliation is off without a URL.
+type Director struct {
+	URL          string        `yaml:"url"`
+	ClientID     string        `yaml:"client_id"`
+	ClientSecret string        `yaml:"client_secret"`
+	CACert       string        `yaml:"ca_cert"`
+	Interval     time.Duration `yaml:"interval"`
+
+	// Agentless deployments get their stats from the vitals the director
+	// keeps, every VitalsInterval (5 minutes by default), instead of from
+	// agents on their VMs.
+	Agentless      []string      `yaml:"agentless"`
+	VitalsInterval time.Duration `yaml:"vitals_interval"`
+}
+
+// Retention is how long raw samples, and their 1-minute, 1-hour and 1-day
+// rollups, are kept (2, 14, 90 and 730 days by default).
+type Retention struct {
+	Raw    time.Duration `yaml:"raw"`
+	Minute time.Duration `yaml:"minute"`
+	Hour   time.Duration `yaml:"hour"`
+	Day    time.Duration `yaml:"day"`
+}
+
+// SLO is an availability target for a deployment, in percent of the time
+// its instances were reporting and not failing, over a rolling Window
+// (30 days by default).
+type SLO struct {
+	Deployment string        `yaml:"deployment"`
+	Target     float64       `yaml:"target"`
+	Window     time.Duration `yaml:"window"`
+}
+
+// Baseline compares stats with the same hour of the day over the last
+// Lookback of history, and flags them as anomalous beyond Sigma standard
+// deviations.
+type Baseline struct {
+	Lookback time.Duration `yaml:"lookback"`
+	Sigma    float64       `yaml:"sigma"`
+}
+
+// Quorum declares how many healthy instances a clustered instance group,
+// such as etcd or mysql, needs to keep working: at least MinHealthy, or a
+// majority of its instances. The majority is taken of Instances when set,
+// and otherwise of the instances the director expects, or that reported.
+type Quorum struct {
+	Deployment   string `yaml:"deployment"`
+	InstanceName string `yaml:"instance_name"`
+	MinHealthy   int    `yaml:"min_healthy"`
+	Majority     bool   `yaml:"majority"`
+	Instances    int    `yaml:"instances"`
+}
+
+// Flapping marks an alert as flapping once it fires or resolves at least
+// Transitions times within Window, and as stable again after a whole
+// Window without transitions. Zero transitions disables it.
+type Flapping struct {
+	Transitions int           `yaml:"transitions"`
+	Window      time.Duration `yaml:"window"`
+}
+
+// Incidents groups instances that go stale or start failing within Window
+// of each other in the same AZ, or else the same deployment, into a single
+// incident once there are at least MinInstances of them. Notifications of
+// single failures are held for Hold first, and dropped if the failure
+// turns out to be part of an incident or recovers by then.
+type Incidents struct {
+	Window       time.Duration `yaml:"window"`
+	MinInstances int           `yaml:"min_instances"`
+	Hold         time.Duration `yaml:"hold"`
+}
+
+// JobConfig selects which rendered job configuration files the agent
+// hashes. Patterns without a slash match the file name, others match the
+// path relative to /var/vcap/jobs (e.g. "uaa/config/*.yml"). Nothing is
+// hashed, and so no config drift reported, until include patterns are set.
+type JobConfig struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
 }
 
 type Config struct {
-	Spec  Spec   `yaml:"spec"`
-	Hub   Hub    `yaml:"hub"`
-	Label string `yaml:"label"`
+	Spec      Spec      `yaml:"spec"`
+	Hub       Hub       `yaml:"hub"`
+	Label     string    `yaml:"label"`
+	JobConfig JobConfig `yaml:"job_config"`
 }
 
 func NewConfig(path string) (Config, error) {
@@ -42,9 +243,131 @@ func NewConfig(path string) (Config, error) {
 		return Config{}, errors.Wrap(err, "unable to read config file")
 	}
 
+	if cfg.Hub.Email.Port == "" {
+		cfg.Hub.Email.Port = "25"
+	}
+
+	if cfg.Hub.Flapping.Window == 0 {
+		cfg.Hub.Flapping.Window = 10 * time.Minute
+	}
+
+	if cfg.Hub.Incidents.Window == 0 {
+		cfg.Hub.Incidents.Window = 5 * time.Minute
+	}
+
+	if cfg.Hub.Incidents.MinInstances == 0 {
+		cfg.Hub.Incidents.MinInstances = 3
+	}
+
+	if cfg.Hub.Incidents.Hold == 0 {
+		cfg.Hub.Incidents.Hold = 30 * time.Second
+	}
+
+	if cfg.Hub.Retention.Raw == 0 {
+		cfg.Hub.Retention.Raw = 2 * 24 * time.Hour
+	}
+
+	if cfg.Hub.Retention.Minute == 0 {
+		cfg.Hub.Retention.Minute = 14 * 24 * time.Hour
+	}
+
+	if cfg.Hub.Retention.Hour == 0 {
+		cfg.Hub.Retention.Hour = 90 * 24 * time.Hour
+	}
+
+	if cfg.Hub.Retention.Day == 0 {
+		cfg.Hub.Retention.Day = 730 * 24 * time.Hour
+	}
+
+	if cfg.Hub.ForecastLookback == 0 {
+		cfg.Hub.ForecastLookback = 7 * 24 * time.Hour
+	}
+
+	if cfg.Hub.Baseline.Lookback == 0 {
+		cfg.Hub.Baseline.Lookback = 28 * 24 * time.Hour
+	}
+
+	if cfg.Hub.Baseline.Sigma == 0 {
+		cfg.Hub.Baseline.Sigma = 3
+	}
+
+	if cfg.Hub.RightsizingWindow == 0 {
+		cfg.Hub.RightsizingWindow = 14 * 24 * time.Hour
+	}
+
+	for i := range cfg.Hub.SLOs {
+		if cfg.Hub.SLOs[i].Window == 0 {
+			cfg.Hub.SLOs[i].Window = 30 * 24 * time.Hour
+		}
+	}
+
+	if cfg.Hub.Director.Interval == 0 {
+		cfg.Hub.Director.Interval = 5 * time.Minute
+	}
+
+	if cfg.Hub.Director.VitalsInterval == 0 {
+		cfg.Hub.Director.VitalsInterval = 5 * time.Minute
+	}
+
+	if cfg.Hub.StaleAfter == 0 {
+		cfg.Hub.StaleAfter = time.Minute
+	}
+
+	if err := validateDurations(cfg.Hub); err != nil {
+		return Config{}, err
+	}
+
 	return cfg, nil
 }
 
+// minInterval is the shortest interval the hub accepts for the durations
+// it runs periodic work at.
+const minInterval = time.Second
+
+// validateDurations rejects negative durations, and intervals too short
+// for the periodic work the hub schedules with them.
+func validateDurations(h Hub) error {
+	type duration struct {
+		name     string
+		value    time.Duration
+		interval bool
+	}
+
+	durations := []duration{
+		{"hub.stale_after", h.StaleAfter, true},
+		{"hub.director.interval", h.Director.Interval, true},
+		{"hub.director.vitals_interval", h.Director.VitalsInterval, true},
+		{"hub.prune_after", h.PruneAfter, false},
+		{"hub.repeat_interval", h.RepeatInterval, false},
+		{"hub.flapping.window", h.Flapping.Window, false},
+		{"hub.incidents.window", h.Incidents.Window, false},
+		{"hub.incidents.hold", h.Incidents.Hold, false},
+		{"hub.retention.raw", h.Retention.Raw, false},
+		{"hub.retention.minute", h.Retention.Minute, false},
+		{"hub.retention.hour", h.Retention.Hour, false},
+		{"hub.retention.day", h.Retention.Day, false},
+		{"hub.forecast_lookback", h.ForecastLookback, false},
+		{"hub.baseline.lookback", h.Baseline.Lookback, false},
+		{"hub.rightsizing_window", h.RightsizingWindow, false},
+	}
+
+	for _, slo := range h.SLOs {
+		durations = append(durations, duration{"hub.slos.window", slo.Window, false})
+	}
+
+	for _, d := range durations {
+		if d.value < 0 {
+			return errors.Errorf("%s must not be negative, got %s", d.name, d.value)
+		}
+
+		if d.interval && d.value < minInterval {
+			return errors.Errorf("%s must be at least %s, got %s", d.name, minInterval, d.value)
+		}
+	}
+
+	return nil
+}
+
 func (h *Hub) Addr() string {
 	return h.IP+":"+h.Port
 }
\ No newline at end of file
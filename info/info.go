@@ -10,3 +10,9 @@ type Info struct {
 	Label string       `json:"label"`
 	Stats system.Stats `json:"system_stats"`
 }
+
+type InventoryInfo struct {
+	Spec      config.Spec      `json:"spec"`
+	Label     string           `json:"label"`
+	Inventory system.Inventory `json:"inventory"`
+}
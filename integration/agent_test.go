@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
+	"syscall"
 )
 
 var _ = Describe("BDD Agent", func() {
@@ -18,25 +20,35 @@ var _ = Describe("BDD Agent", func() {
 		server            *httptest.Server
 		cfg               config.Config
 		actualRequestBody string
+		deleted           []string
+		lock              sync.Mutex
 	)
 
 	BeforeEach(func() {
 		actualRequestBody = ""
+		deleted = nil
 
 		mux := http.NewServeMux()
-		mux.HandleFunc("/health", func(_ http.ResponseWriter, r *http.Request) {
+		mux.HandleFunc("/api/health", func(_ http.ResponseWriter, r *http.Request) {
 			contents, _ := ioutil.ReadAll(r.Body)
 			actualRequestBody = string(contents)
 		})
+		mux.HandleFunc("/api/health/", func(_ http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			deleted = append(deleted, r.Method+" "+r.URL.Path)
+		})
 		server = httptest.NewServer(mux)
 		u, _ := url.Parse(server.URL)
 
 		cfg = config.Config{
 			Spec: config.Spec{
+				ID:         "some-id",
 				Deployment: "some-deployment-name",
 			},
 			Hub: config.Hub{
-				Addr: u.Host,
+				IP:   u.Hostname(),
+				Port: u.Port(),
 			},
 			Label:   "some-deployment-type",
 		}
@@ -58,4 +70,35 @@ var _ = Describe("BDD Agent", func() {
 			ContainSubstring(`"system_stats":`),
 		))
 	})
+
+	It("stays registered with the hub when monit stops it", func() {
+		agentSession = StartAgentWithConfig(cfg)
+
+		Eventually(func() string {
+			return actualRequestBody
+		}, "20s").ShouldNot(BeEmpty())
+
+		agentSession.Signal(syscall.SIGTERM)
+		Eventually(agentSession).Should(gexec.Exit())
+
+		lock.Lock()
+		defer lock.Unlock()
+		Expect(deleted).To(BeEmpty())
+	})
+
+	It("deregisters from the hub in pre-stop when its VM is deleted", func() {
+		agentSession = RunAgentPreStop(cfg, "BOSH_VM_NEXT_STATE=keep")
+		Eventually(agentSession).Should(gexec.Exit(0))
+
+		lock.Lock()
+		Expect(deleted).To(BeEmpty())
+		lock.Unlock()
+
+		agentSession = RunAgentPreStop(cfg, "BOSH_VM_NEXT_STATE=delete")
+		Eventually(agentSession).Should(gexec.Exit(0))
+
+		lock.Lock()
+		defer lock.Unlock()
+		Expect(deleted).To(Equal([]string{"DELETE /api/health/some-id"}))
+	})
 })
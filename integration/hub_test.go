@@ -1,16 +1,21 @@
 package integration
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/aemengo/bosh-deployment-dashboard/config"
 	"github.com/aemengo/bosh-deployment-dashboard/info"
 	"github.com/aemengo/bosh-deployment-dashboard/system"
 	"github.com/jmoiron/sqlx"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/gexec"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
 var _ = Describe("BDD Hub", func() {
@@ -30,7 +35,8 @@ var _ = Describe("BDD Hub", func() {
 
 		cfg = config.Config{
 			Hub: config.Hub{
-				Addr:    "127.0.0.1:" + hubPort,
+				IP:      "127.0.0.1",
+				Port:    hubPort,
 				DataDir: dataDir,
 			},
 		}
@@ -48,14 +54,16 @@ var _ = Describe("BDD Hub", func() {
 	})
 
 	AfterEach(func() {
-		sqlxClient.Close()
+		if sqlxClient != nil {
+			sqlxClient.Close()
+		}
 		hubSession.Kill()
 		os.RemoveAll(dataDir)
 	})
 
-	It("POST /health inserts and updates health metrics to hub", func() {
+	It("POST /api/health inserts and updates health metrics to hub", func() {
 		hubSession = StartHubWithConfig(cfg)
-		response := PostHub("/health", systemInfo)
+		response := PostHub("/api/health", systemInfo)
 		Expect(response.StatusCode).To(Equal(http.StatusOK))
 
 		sqlxClient = GetDBClient(dataDir)
@@ -71,7 +79,7 @@ var _ = Describe("BDD Hub", func() {
 		Expect(persistentDiskUsed).To(Equal(60))
 
 		systemInfo.Stats.PersistentDiskUsed = 80
-		response = PostHub("/health", systemInfo)
+		response = PostHub("/api/health", systemInfo)
 		Expect(response.StatusCode).To(Equal(http.StatusOK))
 
 		err = sqlxClient.Get(&count, "select count(*) from metrics")
@@ -83,16 +91,16 @@ var _ = Describe("BDD Hub", func() {
 		Expect(persistentDiskUsed).To(Equal(80))
 	})
 
-	It("GET /health returns the metrics saved", func() {
+	It("GET /api/health returns the metrics saved", func() {
 		systemInfo.Stats = system.Stats{
 			PersistentDiskUsed: 30,
 		}
 
 		hubSession = StartHubWithConfig(cfg)
-		response := PostHub("/health", systemInfo)
+		response := PostHub("/api/health", systemInfo)
 		Expect(response.StatusCode).To(Equal(http.StatusOK))
 
-		response = HubGet("/health")
+		response = HubGet("/api/health")
 		Expect(response.StatusCode).To(Equal(http.StatusOK))
 
 		contents, err := ioutil.ReadAll(response.Body)
@@ -104,4 +112,1658 @@ var _ = Describe("BDD Hub", func() {
 			ContainSubstring(`"persistent_disk_used":30`),
 		))
 	})
+
+	It("POST /api/inventory stores inventory and GET /api/inventory summarizes it", func() {
+		inventoryInfo := info.InventoryInfo{
+			Spec: systemInfo.Spec,
+			Inventory: system.Inventory{
+				CPUCount:        2,
+				StemcellVersion: "3468.21",
+				AgentVersion:    "some-version",
+			},
+		}
+
+		hubSession = StartHubWithConfig(cfg)
+		response := PostHub("/api/inventory", inventoryInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		response = HubGet("/api/inventory")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			ContainSubstring(`"instance_id":"some-id"`),
+			ContainSubstring(`"agent_version":"some-version"`),
+			ContainSubstring(`"stemcell_versions":{"3468.21":1}`),
+		))
+	})
+
+	It("GET /api/drift flags instances deviating from their instance group", func() {
+		hubSession = StartHubWithConfig(cfg)
+
+		for i, version := range []string{"some-version", "some-version", "other-version"} {
+			response := PostHub("/api/inventory", info.InventoryInfo{
+				Spec: config.Spec{
+					ID:           fmt.Sprintf("some-id-%d", i),
+					InstanceName: "some-instance-name",
+					Deployment:   "some-deployment",
+					Index:        i,
+				},
+				Inventory: system.Inventory{
+					Jobs: map[string]string{"some-job": version},
+				},
+			})
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		response := HubGet("/api/drift")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			ContainSubstring(`"expected_version":"some-version"`),
+			ContainSubstring(`"instance_id":"some-id-2"`),
+			Not(ContainSubstring(`"instance_id":"some-id-0"`)),
+		))
+	})
+
+	It("flags instances whose job config differs from the majority of their instance group", func() {
+		hubSession = StartHubWithConfig(cfg)
+
+		for i, hash := range []string{"some-hash", "some-hash", "other-hash", "some-hash", "other-hash"} {
+			spec := config.Spec{
+				ID:           fmt.Sprintf("some-id-%d", i),
+				InstanceName: "some-instance-name",
+				Deployment:   "some-deployment",
+				Index:        i,
+			}
+
+			// the last two instances make up a group split evenly
+			if i >= 3 {
+				spec.InstanceName = "other-instance-name"
+			}
+
+			response := PostHub("/api/inventory", info.InventoryInfo{
+				Spec: spec,
+				Inventory: system.Inventory{
+					ConfigHashes: map[string]string{"some-job/config/some-job.yml": hash},
+				},
+			})
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+			response = PostHub("/api/health", info.Info{Spec: spec})
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		response := HubGet("/api/drift?kind=config")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			ContainSubstring(`"kind":"config","name":"some-job/config/some-job.yml","expected_version":"some-hash"`),
+			ContainSubstring(`"instance_id":"some-id-2"`),
+			Not(ContainSubstring(`"instance_name":"other-instance-name"`)),
+		))
+
+		response = HubGet("/api/health")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err = ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			MatchRegexp(`"instance_id":"some-id-2",[^}]*"drifted":true,"details":"drifted from instance group: config/some-job/config/some-job.yml"`),
+			MatchRegexp(`"instance_id":"some-id-0",[^}]*"drifted":false`),
+			MatchRegexp(`"instance_id":"some-id-4",[^}]*"drifted":false`),
+		))
+	})
+
+	It("records reboots, recreates, moves and index reassignments", func() {
+		hubSession = StartHubWithConfig(cfg)
+
+		systemInfo.Spec.InstanceName = "some-group"
+		systemInfo.Spec.IP = "10.0.0.1"
+		systemInfo.Spec.AZ = "z1"
+		systemInfo.Stats.Uptime = 100
+
+		report := func(change func()) {
+			change()
+			response := PostHub("/api/health", systemInfo)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		report(func() {})
+		report(func() { systemInfo.Stats.Uptime = 5 })
+		report(func() { systemInfo.Spec.IP = "10.0.0.2" })
+		report(func() { systemInfo.Spec.AZ = "z2" })
+		report(func() { systemInfo.Spec.ID = "some-new-id" })
+		report(func() { systemInfo.Spec.ID = "some-newer-id" })
+
+		response := HubGet("/api/events")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			ContainSubstring(`"kind":"rebooted","message":"uptime went from 100s to 5s"`),
+			ContainSubstring(`"kind":"recreated","message":"ip changed from 10.0.0.1 to 10.0.0.2"`),
+			ContainSubstring(`"kind":"moved","message":"az changed from z1 to z2"`),
+			ContainSubstring(`"message":"some-deployment/some-group/0 was taken over by some-new-id, previously some-id"`),
+			ContainSubstring(`"message":"some-deployment/some-group/0 was taken over by some-newer-id, previously some-new-id"`),
+			Not(ContainSubstring(`"message":"some-deployment/some-group/0 was taken over by some-newer-id, previously some-id"`)),
+		))
+	})
+
+	It("GET /api/events returns the lifecycle of an instance", func() {
+		systemInfo.Stats.Uptime = 100
+
+		hubSession = StartHubWithConfig(cfg)
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		systemInfo.Stats.Uptime = 5
+		response = PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		response = HubGet("/api/events?instance_id=some-id")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(MatchRegexp(`"kind":"first_seen".*"kind":"rebooted"`))
+	})
+
+	It("refuses to start with durations it cannot run periodic work at", func() {
+		for _, invalid := range []struct {
+			change  func()
+			message string
+		}{
+			{func() { cfg.Hub.StaleAfter = time.Nanosecond }, `hub.stale_after must be at least 1s, got 1ns`},
+			{func() { cfg.Hub.PruneAfter = -time.Hour }, `hub.prune_after must not be negative, got -1h0m0s`},
+		} {
+			cfg.Hub.StaleAfter, cfg.Hub.PruneAfter = 0, 0
+			invalid.change()
+
+			hubSession = RunHubWithConfig(cfg)
+			Eventually(hubSession).Should(gexec.Exit(1))
+			Expect(hubSession.Out).To(gbytes.Say("%s", invalid.message))
+		}
+	})
+
+	It("POST /api/annotations marks deploys on the events and history of matching instances", func() {
+		hubSession = StartHubWithConfig(cfg)
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		for _, annotation := range []map[string]interface{}{
+			{"deployment": "some-deployment", "text": "deploying cf v2.3", "tags": []string{"ci"}},
+			{"deployment": "some-deployment", "instance_id": "other-id", "text": "restarting other-id"},
+			{"deployment": "other-deployment", "text": "deploying other-deployment"},
+		} {
+			annotation["starts_at"] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+			annotation["ends_at"] = time.Now().Add(-30 * time.Minute).Format(time.RFC3339)
+
+			response = PostHub("/api/annotations", annotation)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		response = PostHub("/api/annotations", map[string]string{"deployment": "some-deployment"})
+		Expect(response.StatusCode).To(Equal(http.StatusBadRequest))
+
+		response = HubGet("/api/annotations?deployment=some-deployment")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			ContainSubstring(`"text":"deploying cf v2.3","tags":["ci"]`),
+			ContainSubstring(`"text":"restarting other-id"`),
+			Not(ContainSubstring(`"text":"deploying other-deployment"`)),
+		))
+
+		for _, path := range []string{
+			"/api/events?instance_id=some-id&since=" + time.Now().Add(-2*time.Hour).UTC().Format(time.RFC3339),
+			"/api/history?instance_id=some-id&from=" + time.Now().Add(-2*time.Hour).UTC().Format(time.RFC3339),
+		} {
+			response = HubGet(path)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+			contents, err = ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(string(contents)).Should(SatisfyAll(
+				ContainSubstring(`"text":"deploying cf v2.3"`),
+				Not(ContainSubstring(`"text":"restarting other-id"`)),
+				Not(ContainSubstring(`"text":"deploying other-deployment"`)),
+			), path)
+		}
+
+		response = HubGet("/api/annotations?instance_id=unknown-id")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err = ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(strings.TrimSpace(string(contents))).To(Equal("[]"))
+	})
+
+	It("POST /api/silences shows active silences on matching instances", func() {
+		hubSession = StartHubWithConfig(cfg)
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		response = PostHub("/api/silences", map[string]string{
+			"deployment": "some-deployment",
+			"reason":     "some-reason",
+			"ends_at":    time.Now().Add(time.Hour).Format(time.RFC3339),
+		})
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		response = HubGet("/api/health")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(ContainSubstring(`"reason":"some-reason"`))
+	})
+
+	It("holds notifications of silenced instances but still records their alerts", func() {
+		smtpPort, messages := StartFakeSMTPServer()
+
+		cfg.Hub.Email = config.Email{
+			Host: "127.0.0.1",
+			Port: smtpPort,
+			From: "bdd@example.com",
+			To:   []string{"ops@example.com"},
+		}
+		cfg.Hub.Alerts = []config.AlertRule{
+			{Name: "high-cpu", Stat: "cpu_used", Threshold: 90},
+		}
+		cfg.Hub.RepeatInterval = time.Second
+		cfg.Hub.Incidents.Hold = time.Second
+		systemInfo.Stats.CpuUsed = 95
+
+		hubSession = StartHubWithConfig(cfg)
+
+		response := PostHub("/api/silences", map[string]string{
+			"deployment": "some-deployment",
+			"reason":     "some-reason",
+			"ends_at":    time.Now().Add(4 * time.Second).Format(time.RFC3339),
+		})
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		response = PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		Consistently(messages, "2s").ShouldNot(Receive())
+
+		response = HubGet("/api/events?instance_id=some-id")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).Should(ContainSubstring(`"kind":"alert_fired"`))
+
+		response = HubGet("/api/alerts?state=firing")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err = ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).Should(ContainSubstring(`"rule":"high-cpu"`))
+
+		Eventually(messages, "5s").Should(Receive(ContainSubstring("still firing since")))
+	})
+
+	It("acknowledging an alert holds its repeats until the ack is cleared or the alert resolves", func() {
+		smtpPort, messages := StartFakeSMTPServer()
+
+		cfg.Hub.Email = config.Email{
+			Host: "127.0.0.1",
+			Port: smtpPort,
+			From: "bdd@example.com",
+			To:   []string{"ops@example.com"},
+		}
+		cfg.Hub.Alerts = []config.AlertRule{
+			{Name: "high-cpu", Stat: "cpu_used", Threshold: 90},
+		}
+		cfg.Hub.RepeatInterval = time.Second
+		systemInfo.Stats.CpuUsed = 95
+
+		cfg.Hub.Incidents.Hold = time.Second
+		hubSession = StartHubWithConfig(cfg)
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		Eventually(messages).Should(Receive(ContainSubstring("Subject: [bdd] alert_fired: some-deployment")))
+
+		response = HubGet("/api/alerts?state=firing")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		var alerts []struct {
+			ID int `json:"id"`
+		}
+		Expect(json.NewDecoder(response.Body).Decode(&alerts)).To(Succeed())
+		Expect(alerts).To(HaveLen(1))
+
+		ackPath := fmt.Sprintf("/api/alerts/%d/ack", alerts[0].ID)
+
+		request, err := http.NewRequest(http.MethodPut, "http://127.0.0.1:"+hubPort+ackPath, nil)
+		Expect(err).NotTo(HaveOccurred())
+		response, err = http.DefaultClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+
+		response = PostHub(ackPath, map[string]string{"comment": "on it"})
+		Expect(response.StatusCode).To(Equal(http.StatusBadRequest))
+
+		acknowledge := func() {
+			response := PostHub(ackPath, map[string]string{"owner": "some-owner", "comment": "on it"})
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+			// a repeat may have been on its way before the ack
+			for len(messages) > 0 {
+				<-messages
+			}
+		}
+
+		acknowledge()
+		Consistently(messages, "3s").ShouldNot(Receive())
+
+		Expect(HubDelete(ackPath)).To(Equal(http.StatusOK))
+		Eventually(messages).Should(Receive(ContainSubstring("still firing since")))
+
+		acknowledge()
+
+		systemInfo.Stats.CpuUsed = 10
+		response = PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		response = HubGet(fmt.Sprintf("/api/alerts/%d", alerts[0].ID))
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			ContainSubstring(`"state":"resolved"`),
+			Not(ContainSubstring(`"acknowledged_by"`)),
+			MatchRegexp(`"action":"acknowledged","owner":"some-owner","comment":"on it".*`+
+				`"action":"cleared","owner":"some-owner","comment":"cleared by hand".*`+
+				`"action":"acknowledged","owner":"some-owner","comment":"on it".*`+
+				`"action":"cleared","owner":"some-owner","comment":"alert resolved"`),
+		))
+	})
+
+	It("sends an email when an alert fires", func() {
+		smtpPort, messages := StartFakeSMTPServer()
+
+		cfg.Hub.Email = config.Email{
+			Host: "127.0.0.1",
+			Port: smtpPort,
+			From: "bdd@example.com",
+			To:   []string{"ops@example.com"},
+		}
+		cfg.Hub.Alerts = []config.AlertRule{
+			{Name: "high-cpu", Stat: "cpu_used", Threshold: 90},
+		}
+		systemInfo.Stats.CpuUsed = 95
+
+		cfg.Hub.Incidents.Hold = time.Second
+		hubSession = StartHubWithConfig(cfg)
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		var message string
+		Eventually(messages).Should(Receive(&message))
+		Expect(message).Should(SatisfyAll(
+			ContainSubstring("To: ops@example.com"),
+			ContainSubstring("Subject: [bdd] alert_fired: some-deployment"),
+			ContainSubstring("high-cpu: cpu_used is 95.00"),
+		))
+	})
+
+	It("keeps reports fast while the mail server hangs", func() {
+		cfg.Hub.Email = config.Email{
+			Host: "127.0.0.1",
+			Port: StartStalledSMTPServer(),
+			From: "bdd@example.com",
+			To:   []string{"ops@example.com"},
+		}
+		cfg.Hub.Alerts = []config.AlertRule{
+			{Name: "high-cpu", Stat: "cpu_used", Threshold: 90},
+		}
+		systemInfo.Stats.CpuUsed = 95
+
+		hubSession = StartHubWithConfig(cfg)
+
+		for i := 0; i < 3; i++ {
+			systemInfo.Spec.ID = fmt.Sprintf("some-id-%d", i)
+
+			start := time.Now()
+			response := PostHub("/api/health", systemInfo)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		}
+	})
+
+	It("keeps names reported by agents from adding email headers", func() {
+		smtpPort, messages := StartFakeSMTPServer()
+
+		cfg.Hub.Email = config.Email{
+			Host: "127.0.0.1",
+			Port: smtpPort,
+			From: "bdd@example.com",
+			To:   []string{"ops@example.com"},
+		}
+		cfg.Hub.Alerts = []config.AlertRule{
+			{Name: "high-cpu", Stat: "cpu_used", Threshold: 90},
+		}
+		systemInfo.Spec.Deployment = "some-deployment\r\nBcc: someone@example.com"
+		systemInfo.Stats.CpuUsed = 95
+
+		cfg.Hub.Incidents.Hold = time.Second
+		hubSession = StartHubWithConfig(cfg)
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		var message string
+		Eventually(messages).Should(Receive(&message))
+
+		headers := strings.SplitN(message, "\r\n\r\n", 2)[0]
+		Expect(headers).Should(SatisfyAll(
+			ContainSubstring("Subject: [bdd] alert_fired: some-deployment  Bcc: someone@example.com//0\r\n"),
+			Not(ContainSubstring("\r\nBcc:")),
+		))
+	})
+
+	It("routes alert emails to the receiver of the matching route", func() {
+		smtpPort, messages := StartFakeSMTPServer()
+
+		cfg.Hub.Email = config.Email{
+			Host: "127.0.0.1",
+			Port: smtpPort,
+			From: "bdd@example.com",
+		}
+		cfg.Hub.Receivers = []config.Receiver{
+			{Name: "ops", Email: []string{"ops@example.com"}},
+			{Name: "oncall", Email: []string{"oncall@example.com"}},
+		}
+		cfg.Hub.Route = config.Route{
+			Receiver: "ops",
+			Routes: []config.Route{
+				{Match: config.RouteMatch{Severity: "critical"}, Receiver: "oncall"},
+			},
+		}
+		cfg.Hub.Alerts = []config.AlertRule{
+			{Name: "high-cpu", Stat: "cpu_used", Threshold: 90, Severity: "critical"},
+		}
+		systemInfo.Stats.CpuUsed = 95
+
+		cfg.Hub.Incidents.Hold = time.Second
+		hubSession = StartHubWithConfig(cfg)
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		var message string
+		Eventually(messages).Should(Receive(&message))
+		Expect(message).Should(SatisfyAll(
+			ContainSubstring("To: oncall@example.com"),
+			ContainSubstring("high-cpu: cpu_used is 95.00"),
+		))
+		Consistently(messages).ShouldNot(Receive())
+	})
+
+	It("keeps reports fast while the mail server of a routed receiver hangs", func() {
+		cfg.Hub.Email = config.Email{
+			Host: "127.0.0.1",
+			Port: StartStalledSMTPServer(),
+			From: "bdd@example.com",
+		}
+		cfg.Hub.Receivers = []config.Receiver{
+			{Name: "ops", Email: []string{"ops@example.com"}},
+		}
+		cfg.Hub.Route = config.Route{Receiver: "ops"}
+		cfg.Hub.Alerts = []config.AlertRule{
+			{Name: "high-cpu", Stat: "cpu_used", Threshold: 90},
+		}
+		systemInfo.Stats.CpuUsed = 95
+
+		hubSession = StartHubWithConfig(cfg)
+
+		for i := 0; i < 3; i++ {
+			systemInfo.Spec.ID = fmt.Sprintf("some-id-%d", i)
+
+			start := time.Now()
+			response := PostHub("/api/health", systemInfo)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		}
+	})
+
+	It("marks an alert that keeps firing and resolving as flapping", func() {
+		smtpPort, messages := StartFakeSMTPServer()
+
+		cfg.Hub.Email = config.Email{
+			Host: "127.0.0.1",
+			Port: smtpPort,
+			From: "bdd@example.com",
+			To:   []string{"ops@example.com"},
+		}
+		cfg.Hub.Flapping = config.Flapping{Transitions: 3}
+		cfg.Hub.Alerts = []config.AlertRule{
+			{Name: "high-cpu", Stat: "cpu_used", Threshold: 90},
+		}
+		cfg.Hub.Incidents.Hold = time.Second
+
+		hubSession = StartHubWithConfig(cfg)
+
+		for _, step := range []struct {
+			cpu     float64
+			subject string
+		}{
+			{95, "Subject: [bdd] alert_fired: "},
+			{10, "Subject: [bdd] alert_resolved: "},
+			{95, "Subject: [bdd] flapping: "},
+		} {
+			systemInfo.Stats.CpuUsed = step.cpu
+			response := PostHub("/api/health", systemInfo)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+			Eventually(messages, "3s").Should(Receive(ContainSubstring(step.subject)))
+		}
+
+		// the alert keeps firing and resolving, but only flapping is told
+		for _, cpu := range []float64{10, 95, 10, 95} {
+			systemInfo.Stats.CpuUsed = cpu
+			response := PostHub("/api/health", systemInfo)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		Consistently(messages, "2s").ShouldNot(Receive())
+
+		response := HubGet("/api/alerts?state=firing")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(ContainSubstring(`"flapping":true`))
+
+		response = HubGet("/api/events?instance_id=some-id")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err = ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(ContainSubstring(`"kind":"flapping"`))
+	})
+
+	It("GET /api/incidents groups instances failing in the same az", func() {
+		cfg.Hub.Alerts = []config.AlertRule{
+			{Name: "high-cpu", Stat: "cpu_used", Threshold: 90},
+		}
+
+		hubSession = StartHubWithConfig(cfg)
+
+		for i := 0; i < 3; i++ {
+			systemInfo.Spec.ID = fmt.Sprintf("some-id-%d", i)
+			systemInfo.Spec.Deployment = fmt.Sprintf("some-deployment-%d", i)
+			systemInfo.Spec.AZ = "some-az"
+			systemInfo.Stats.CpuUsed = 95
+
+			response := PostHub("/api/health", systemInfo)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		response := HubGet("/api/incidents?state=open")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			ContainSubstring(`"scope":"az","value":"some-az"`),
+			ContainSubstring(`"instance_id":"some-id-0"`),
+			ContainSubstring(`"instance_id":"some-id-2"`),
+		))
+	})
+
+	It("notifies an incident in place of the failures it correlates, routed by its deployment", func() {
+		smtpPort, messages := StartFakeSMTPServer()
+
+		cfg.Hub.Email = config.Email{
+			Host: "127.0.0.1",
+			Port: smtpPort,
+			From: "bdd@example.com",
+		}
+		cfg.Hub.Receivers = []config.Receiver{
+			{Name: "ops", Email: []string{"ops@example.com"}},
+			{Name: "some-team", Email: []string{"some-team@example.com"}},
+		}
+		cfg.Hub.Route = config.Route{
+			Receiver: "ops",
+			Routes: []config.Route{
+				{Match: config.RouteMatch{Deployment: "some-deployment"}, Receiver: "some-team"},
+			},
+		}
+		cfg.Hub.Alerts = []config.AlertRule{
+			{Name: "high-cpu", Stat: "cpu_used", Threshold: 90},
+		}
+		cfg.Hub.Incidents.Hold = 2 * time.Second
+
+		hubSession = StartHubWithConfig(cfg)
+
+		for i := 0; i < 3; i++ {
+			systemInfo.Spec.ID = fmt.Sprintf("some-id-%d", i)
+			systemInfo.Spec.Index = i
+			systemInfo.Spec.AZ = "some-az"
+			systemInfo.Stats.CpuUsed = 95
+
+			response := PostHub("/api/health", systemInfo)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		var message string
+		Eventually(messages).Should(Receive(&message))
+		Expect(message).Should(SatisfyAll(
+			ContainSubstring("To: some-team@example.com"),
+			ContainSubstring("Subject: [bdd] incident_opened: some-deployment\r\n"),
+		))
+		Consistently(messages, "4s").ShouldNot(Receive())
+
+		for i := 0; i < 3; i++ {
+			systemInfo.Spec.ID = fmt.Sprintf("some-id-%d", i)
+			systemInfo.Spec.Index = i
+			systemInfo.Stats.CpuUsed = 10
+
+			response := PostHub("/api/health", systemInfo)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		Eventually(messages).Should(Receive(&message))
+		Expect(message).Should(ContainSubstring("Subject: [bdd] incident_resolved: some-deployment\r\n"))
+		Consistently(messages, "3s").ShouldNot(Receive())
+	})
+
+	It("GET /api/groups rolls up the instances of each instance group", func() {
+		hubSession = StartHubWithConfig(cfg)
+
+		for i, cpu := range []float64{10, 30} {
+			systemInfo.Spec.ID = fmt.Sprintf("some-id-%d", i)
+			systemInfo.Spec.InstanceName = "some-group"
+			systemInfo.Spec.Index = i
+			systemInfo.Stats.CpuUsed = cpu
+
+			response := PostHub("/api/health", systemInfo)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		response := HubGet("/api/groups?deployment=some-deployment")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			ContainSubstring(`"name":"some-group","instances":2,"healthy":2`),
+			ContainSubstring(`"cpu_used":{"min":10,"avg":20,"max":30}`),
+		))
+	})
+
+	It("GET /api/deployments reports quorum loss of a clustered instance group", func() {
+		cfg.Hub.Alerts = []config.AlertRule{
+			{Name: "high-cpu", Stat: "cpu_used", Threshold: 90},
+		}
+		cfg.Hub.Quorums = []config.Quorum{
+			{Deployment: "some-deployment", InstanceName: "some-group", Majority: true},
+		}
+
+		smtpPort, messages := StartFakeSMTPServer()
+
+		cfg.Hub.Email = config.Email{
+			Host: "127.0.0.1",
+			Port: smtpPort,
+			From: "bdd@example.com",
+			To:   []string{"ops@example.com"},
+		}
+
+		hubSession = StartHubWithConfig(cfg)
+
+		for i, cpu := range []float64{10, 95, 95} {
+			systemInfo.Spec.ID = fmt.Sprintf("some-id-%d", i)
+			systemInfo.Spec.InstanceName = "some-group"
+			systemInfo.Spec.Index = i
+			systemInfo.Stats.CpuUsed = cpu
+
+			response := PostHub("/api/health", systemInfo)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		response := HubGet("/api/deployments")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			ContainSubstring(`"status":"quorum_lost"`),
+			ContainSubstring(`"quorum_lost":["some-group"]`),
+		))
+
+		Eventually(messages).Should(Receive(ContainSubstring("Subject: [bdd] quorum_lost: some-deployment/some-group\r\n")))
+	})
+
+	It("takes the quorum majority of the instances the director expects", func() {
+		director := StartFakeDirector(map[string][]FakeDirectorInstance{
+			"some-deployment": {
+				{ID: "some-id-0", Job: "some-group", Index: 0, AZ: "z1", ExpectsVM: true},
+				{ID: "some-id-1", Job: "some-group", Index: 1, AZ: "z1", ExpectsVM: true},
+				{ID: "some-id-2", Job: "some-group", Index: 2, AZ: "z2", ExpectsVM: true},
+				{ID: "some-id-3", Job: "some-group", Index: 3, AZ: "z2", ExpectsVM: true},
+			},
+		})
+		defer director.Close()
+
+		cfg.Hub.Director = config.Director{
+			URL:          director.URL,
+			ClientID:     "some-client",
+			ClientSecret: "some-secret",
+			CACert:       director.CACert,
+			Interval:     time.Second,
+		}
+		cfg.Hub.Quorums = []config.Quorum{
+			{Deployment: "some-deployment", InstanceName: "some-group", Majority: true},
+		}
+
+		hubSession = StartHubWithConfig(cfg)
+
+		for i := 0; i < 2; i++ {
+			systemInfo.Spec.ID = fmt.Sprintf("some-id-%d", i)
+			systemInfo.Spec.InstanceName = "some-group"
+			systemInfo.Spec.Index = i
+
+			response := PostHub("/api/health", systemInfo)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		Eventually(func() string {
+			response := HubGet("/api/groups")
+			contents, _ := ioutil.ReadAll(response.Body)
+			return string(contents)
+		}).Should(ContainSubstring(`"quorum":{"expected":4,"required":3,"lost":true}`))
+	})
+
+	It("fires outlier alerts for instances far from their instance group peers", func() {
+		cfg.Hub.Alerts = []config.AlertRule{
+			{Name: "memory-outlier", Type: "outlier", Stat: "memory_used"},
+		}
+
+		hubSession = StartHubWithConfig(cfg)
+
+		for i, memory := range []float64{40, 42, 38, 41, 90} {
+			systemInfo.Spec.ID = fmt.Sprintf("some-id-%d", i)
+			systemInfo.Spec.InstanceName = "some-group"
+			systemInfo.Spec.Index = i
+			systemInfo.Stats.MemoryUsed = memory
+
+			response := PostHub("/api/health", systemInfo)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		response := HubGet("/api/outliers?stat=memory_used")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			ContainSubstring(`"instance_id":"some-id-4"`),
+			Not(ContainSubstring(`"instance_id":"some-id-0"`)),
+		))
+
+		response = HubGet("/api/alerts?state=firing")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err = ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			ContainSubstring(`"instance_id":"some-id-4"`),
+			ContainSubstring(`"rule_type":"outlier"`),
+		))
+	})
+
+	It("scores outliers on recent history and leaves stale peers out", func() {
+		hubSession = StartHubWithConfig(cfg)
+
+		for i, memory := range []float64{40, 42, 60, 41, 90} {
+			systemInfo.Spec.ID = fmt.Sprintf("some-id-%d", i)
+			systemInfo.Spec.InstanceName = "some-group"
+			systemInfo.Spec.Index = i
+			systemInfo.Stats.MemoryUsed = memory
+
+			response := PostHub("/api/health", systemInfo)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		sqlxClient = GetDBClient(dataDir)
+
+		for minute := 4; minute > 0; minute-- {
+			SeedHistory(sqlxClient, "some-id-2", time.Now().Add(-time.Duration(minute)*time.Minute), map[string]float64{
+				"memory_used": 40,
+			})
+		}
+
+		_, err := sqlxClient.Exec("update metrics set updated_at = $1 where instance_id = $2", DBTime(time.Now().Add(-time.Hour)), "some-id-4")
+		Expect(err).NotTo(HaveOccurred())
+
+		response := HubGet("/api/outliers?stat=memory_used")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			Not(ContainSubstring(`"instance_id":"some-id-2"`)),
+			Not(ContainSubstring(`"instance_id":"some-id-4"`)),
+		))
+	})
+
+	It("forecasts when a persistent disk fills up from its history", func() {
+		cfg.Hub.Alerts = []config.AlertRule{
+			{Name: "disk-full-soon", Type: "forecast", Stat: "persistent_disk_used", Within: 72 * time.Hour},
+		}
+
+		hubSession = StartHubWithConfig(cfg)
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		sqlxClient = GetDBClient(dataDir)
+
+		for hour := 12; hour > 0; hour-- {
+			SeedHistory(sqlxClient, "some-id", time.Now().Add(-time.Duration(hour)*time.Hour), map[string]float64{
+				"persistent_disk_used": 64 - 2*float64(hour),
+			})
+		}
+
+		systemInfo.Stats.PersistentDiskUsed = 64
+		response = PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		response = HubGet("/api/health")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(MatchRegexp(`"disk_forecast":\{"instance_id":"some-id",[^}]*"hours_to_full":\d`))
+
+		response = HubGet("/api/alerts?state=firing")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err = ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(ContainSubstring(`"rule":"disk-full-soon"`))
+	})
+
+	It("flags stats far from their usual value at this hour of the day", func() {
+		cfg.Hub.Alerts = []config.AlertRule{
+			{Name: "unusual-cpu", Type: "baseline", Stat: "cpu_used"},
+		}
+
+		hubSession = StartHubWithConfig(cfg)
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		sqlxClient = GetDBClient(dataDir)
+
+		for day := 1; day <= 14; day++ {
+			SeedHistory(sqlxClient, "some-id", time.Now().AddDate(0, 0, -day), map[string]float64{
+				"cpu_used": 30 + float64(day%3),
+			})
+		}
+
+		systemInfo.Stats.CpuUsed = 90
+		response = PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		response = HubGet("/api/anomalies")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(ContainSubstring(`"instance_id":"some-id","deployment":"some-deployment","name":"","stat":"cpu_used"`))
+
+		response = HubGet("/api/alerts?state=firing")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err = ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(ContainSubstring(`"rule":"unusual-cpu"`))
+	})
+
+	It("GET /api/reports/rightsizing recommends sizes from utilization history", func() {
+		hubSession = StartHubWithConfig(cfg)
+
+		systemInfo.Spec.InstanceName = "some-group"
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		sqlxClient = GetDBClient(dataDir)
+
+		for hour := 1; hour <= 12; hour++ {
+			SeedHistory(sqlxClient, "some-id", time.Now().Add(-time.Duration(hour)*time.Hour), map[string]float64{
+				"cpu_used":    95,
+				"memory_used": 50,
+			})
+		}
+
+		response = HubGet("/api/reports/rightsizing")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			ContainSubstring(`"name":"some-group"`),
+			ContainSubstring(`"cpu_p95":95`),
+			ContainSubstring(`"recommendation":"under_provisioned"`),
+		))
+
+		response = HubGet("/api/reports/rightsizing?format=csv")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		Expect(response.Header.Get("Content-Type")).To(Equal("text/csv"))
+
+		contents, err = ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(ContainSubstring("some-deployment,some-group,1,13,0,0,95.00,50.00,under_provisioned"))
+	})
+
+	It("reports availability and SLO error budgets from the status history", func() {
+		cfg.Hub.SLOs = []config.SLO{
+			{Deployment: "some-deployment", Target: 99},
+		}
+
+		hubSession = StartHubWithConfig(cfg)
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		sqlxClient = GetDBClient(dataDir)
+
+		for _, change := range []struct {
+			status string
+			hours  int
+		}{{"healthy", 10}, {"stale", 2}, {"healthy", 1}} {
+			SeedStatus(sqlxClient, "some-id", change.status, time.Now().Add(-time.Duration(change.hours)*time.Hour))
+		}
+
+		response = HubGet("/api/reports/availability?deployment=some-deployment")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(MatchRegexp(`"deployment":"some-deployment","availability":90(\.0\d*)?,`))
+
+		response = HubGet("/api/slos")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err = ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(MatchRegexp(`"target":99,.*"burn_rate":(9\.99\d*|10),`))
+	})
+
+	It("carries the status before the report period in and counts missing agents as unavailable", func() {
+		director := StartFakeDirector(map[string][]FakeDirectorInstance{
+			"some-deployment": {
+				{ID: "some-id", Job: "some-group", Index: 0, AZ: "z1", ExpectsVM: true},
+				{ID: "some-missing-id", Job: "some-group", Index: 1, AZ: "z2", ExpectsVM: true},
+			},
+		})
+		defer director.Close()
+
+		cfg.Hub.Director = config.Director{
+			URL:          director.URL,
+			ClientID:     "some-client",
+			ClientSecret: "some-secret",
+			CACert:       director.CACert,
+			Interval:     time.Second,
+		}
+
+		hubSession = StartHubWithConfig(cfg)
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		Eventually(func() string {
+			response := HubGet("/api/reconciliation")
+			contents, _ := ioutil.ReadAll(response.Body)
+			return string(contents)
+		}).Should(ContainSubstring(`"instance_id":"some-missing-id"`))
+
+		sqlxClient = GetDBClient(dataDir)
+
+		SeedStatus(sqlxClient, "some-id", "failing", time.Now().Add(-3*time.Hour))
+		SeedStatus(sqlxClient, "some-id", "healthy", time.Now().Add(-time.Hour))
+
+		_, err := sqlxClient.Exec("update status_history set started_at = $1 where instance_id = $2", DBTime(time.Now().Add(-time.Hour)), "some-missing-id")
+		Expect(err).NotTo(HaveOccurred())
+
+		from := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+		response = HubGet("/api/reports/availability?deployment=some-deployment&from=" + from)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			MatchRegexp(`"instance_id":"some-id",[^}]*"availability":(49\.9\d*|50(\.0\d*)?),`),
+			MatchRegexp(`"instance_id":"some-missing-id",[^}]*"availability":0,`),
+		))
+	})
+
+	It("keeps the downtime of removed instances in availability reports", func() {
+		hubSession = StartHubWithConfig(cfg)
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		sqlxClient = GetDBClient(dataDir)
+
+		for _, change := range []struct {
+			status string
+			hours  int
+		}{{"healthy", 3}, {"failing", 2}, {"healthy", 1}} {
+			SeedStatus(sqlxClient, "some-id", change.status, time.Now().Add(-time.Duration(change.hours)*time.Hour))
+		}
+
+		Expect(HubDelete("/api/health/some-id")).To(Equal(http.StatusOK))
+
+		from := time.Now().Add(-3 * time.Hour).UTC().Format(time.RFC3339)
+		response = HubGet("/api/reports/availability?deployment=some-deployment&from=" + from)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			MatchRegexp(`"deployment":"some-deployment","availability":66\.6`),
+			MatchRegexp(`"instance_id":"some-id",[^}]*"availability":66\.6`),
+		))
+	})
+
+	It("rolls history up into tiers and picks the tier from the requested range", func() {
+		hubSession = StartHubWithConfig(cfg)
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		sqlxClient = GetDBClient(dataDir)
+
+		start := time.Now().UTC().Truncate(time.Hour).Add(-3 * time.Hour)
+		for i := 0; i < 6; i++ {
+			SeedHistory(sqlxClient, "some-id", start.Add(time.Duration(i)*10*time.Second), map[string]float64{
+				"cpu_used": 10 * float64(i+1),
+			})
+		}
+
+		// history is rolled up when the hub starts
+		hubSession.Kill()
+		Eventually(hubSession).Should(gexec.Exit())
+		hubSession = StartHubWithConfig(cfg)
+
+		from := time.Now().Add(-30 * 24 * time.Hour).UTC().Format(time.RFC3339)
+
+		Eventually(func() string {
+			response := HubGet("/api/history?instance_id=some-id&from=" + from)
+			contents, _ := ioutil.ReadAll(response.Body)
+			return string(contents)
+		}).Should(SatisfyAll(
+			ContainSubstring(`"tier":"1h"`),
+			ContainSubstring(`"samples":6,"stats":{"cpu_used":{"min":10,"avg":35,"max":60,"last":60,"stddev":17.07`),
+		))
+
+		from = time.Now().Add(-4 * time.Hour).UTC().Format(time.RFC3339)
+
+		response = HubGet("/api/history?instance_id=some-id&step=1m&from=" + from)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			ContainSubstring(`"tier":"1m"`),
+			ContainSubstring(`"samples":6,`),
+			ContainSubstring(`"samples":1,`),
+		))
+	})
+
+	It("keeps baselines and rightsizing on samples once history is rolled up", func() {
+		cfg.Hub.Alerts = []config.AlertRule{
+			{Name: "unusual-cpu", Type: "baseline", Stat: "cpu_used"},
+		}
+
+		hubSession = StartHubWithConfig(cfg)
+
+		systemInfo.Spec.InstanceName = "some-group"
+		systemInfo.Stats.CpuUsed = 30
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		sqlxClient = GetDBClient(dataDir)
+
+		for day := 1; day <= 14; day++ {
+			start := time.Now().AddDate(0, 0, -day).Truncate(time.Hour)
+
+			for i := 0; i < 6; i++ {
+				SeedHistory(sqlxClient, "some-id", start.Add(time.Duration(i)*10*time.Second), map[string]float64{
+					"cpu_used": 20 + 20*float64(i%2) + float64(day%3),
+				})
+			}
+		}
+
+		// history is rolled up when the hub starts
+		hubSession.Kill()
+		Eventually(hubSession).Should(gexec.Exit())
+		hubSession = StartHubWithConfig(cfg)
+
+		from := time.Now().Add(-30 * 24 * time.Hour).UTC().Format(time.RFC3339)
+
+		Eventually(func() string {
+			response := HubGet("/api/history?instance_id=some-id&from=" + from)
+			contents, _ := ioutil.ReadAll(response.Body)
+			return string(contents)
+		}).Should(MatchRegexp(`"tier":"1h".*"samples":6,`))
+
+		// within the spread of the samples at this hour, though far from
+		// the average of any hour
+		systemInfo.Stats.CpuUsed = 40
+		response = PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		response = HubGet("/api/anomalies")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(Equal("[]\n"))
+
+		systemInfo.Stats.CpuUsed = 95
+		response = PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		response = HubGet("/api/anomalies")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err = ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(ContainSubstring(`"instance_id":"some-id"`))
+
+		response = HubGet("/api/reports/rightsizing")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err = ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		// the p95 of the minutes of utilization, not of their peaks
+		Expect(string(contents)).Should(SatisfyAll(
+			ContainSubstring(`"samples":81,`),
+			ContainSubstring(`"cpu_p95":32,`),
+		))
+	})
+
+	It("GET /api/health?at= reconstructs the fleet at a point in time", func() {
+		hubSession = StartHubWithConfig(cfg)
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		sqlxClient = GetDBClient(dataDir)
+
+		reportedAt := time.Now().UTC().Add(-2 * time.Hour)
+
+		SeedHistory(sqlxClient, "some-id", reportedAt, map[string]float64{"cpu_used": 42})
+		SeedStatus(sqlxClient, "some-id", "failing", reportedAt.Add(-time.Hour))
+
+		snapshot := func(at time.Time) string {
+			response := HubGet("/api/health?at=" + at.Format(time.RFC3339))
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+			contents, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			return string(contents)
+		}
+
+		Expect(snapshot(reportedAt.Add(30 * time.Second))).Should(SatisfyAll(
+			ContainSubstring(`"instance_id":"some-id"`),
+			ContainSubstring(`"cpu_used":42`),
+			ContainSubstring(`"status":"failing"`),
+		))
+
+		Expect(snapshot(reportedAt.Add(30 * time.Minute))).Should(ContainSubstring(`"status":"stale"`))
+
+		Expect(snapshot(reportedAt.Add(-time.Hour))).Should(Equal("[]\n"))
+	})
+
+	It("GET /api/health?at= shows instances as they were, even once removed", func() {
+		hubSession = StartHubWithConfig(cfg)
+
+		systemInfo.Spec.IP = "10.0.0.1"
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		sqlxClient = GetDBClient(dataDir)
+
+		reportedAt := time.Now().UTC().Add(-2 * time.Hour)
+
+		_, err := sqlxClient.Exec("update identity_history set started_at = $1 where instance_id = $2", DBTime(reportedAt), "some-id")
+		Expect(err).NotTo(HaveOccurred())
+
+		SeedHistory(sqlxClient, "some-id", reportedAt, map[string]float64{"cpu_used": 42})
+
+		systemInfo.Spec.IP = "10.0.0.2"
+		response = PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		Expect(HubDelete("/api/health/some-id")).To(Equal(http.StatusOK))
+
+		snapshot := func(at time.Time) string {
+			response := HubGet("/api/health?at=" + at.Format(time.RFC3339))
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+			contents, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			return string(contents)
+		}
+
+		Expect(snapshot(reportedAt.Add(time.Minute))).Should(SatisfyAll(
+			ContainSubstring(`"instance_id":"some-id"`),
+			ContainSubstring(`"ip":"10.0.0.1"`),
+			ContainSubstring(`"cpu_used":42`),
+		))
+
+		Expect(snapshot(time.Now().Add(time.Second))).Should(Equal("[]\n"))
+	})
+
+	It("GET /api/health supports ETags and changes since a cursor", func() {
+		hubSession = StartHubWithConfig(cfg)
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		response = HubGet("/api/health")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		etag := response.Header.Get("ETag")
+		Expect(etag).NotTo(BeEmpty())
+
+		request, err := http.NewRequest("GET", "http://127.0.0.1:"+hubPort+"/api/health", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.Header.Set("If-None-Match", etag)
+
+		response, err = http.DefaultClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusNotModified))
+
+		sqlxClient = GetDBClient(dataDir)
+		_, err = sqlxClient.Exec("insert into removed_instances (instance_id) values ($1)", "some-removed-id")
+		Expect(err).NotTo(HaveOccurred())
+
+		response = HubGet("/api/health?since=0")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			MatchRegexp(`"cursor":"\d+"`),
+			ContainSubstring(`"instance_id":"some-id"`),
+			ContainSubstring(`"removed":["some-removed-id"]`),
+		))
+
+		later := fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix())
+		response = HubGet("/api/health?since=" + later)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err = ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(ContainSubstring(`"instances":[],"removed":[]`))
+	})
+
+	It("GET /api/health changes its ETag with every report, even within a second", func() {
+		hubSession = StartHubWithConfig(cfg)
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		get := func(path string, etag string) *http.Response {
+			request, err := http.NewRequest("GET", "http://127.0.0.1:"+hubPort+path, nil)
+			Expect(err).NotTo(HaveOccurred())
+			request.Header.Set("If-None-Match", etag)
+
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			return response
+		}
+
+		etag := HubGet("/api/health").Header.Get("ETag")
+		sinceETag := HubGet("/api/health?since=0").Header.Get("ETag")
+		Expect(sinceETag).NotTo(Equal(etag))
+
+		Expect(get("/api/health", etag).StatusCode).To(Equal(http.StatusNotModified))
+		Expect(get("/api/health?since=0", sinceETag).StatusCode).To(Equal(http.StatusNotModified))
+
+		systemInfo.Stats.CpuUsed = 42
+		response = PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		response = get("/api/health", etag)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).Should(ContainSubstring(`"cpu_used":42`))
+	})
+
+	It("GET /api/health?since= delivers instances whose silences changed", func() {
+		hubSession = StartHubWithConfig(cfg)
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		// cursors have a resolution of one second
+		time.Sleep(1100 * time.Millisecond)
+
+		var changes struct {
+			Cursor    string            `json:"cursor"`
+			Instances []json.RawMessage `json:"instances"`
+		}
+
+		response = HubGet("/api/health?since=0")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		Expect(json.NewDecoder(response.Body).Decode(&changes)).To(Succeed())
+
+		cursor := changes.Cursor
+
+		response = HubGet("/api/health?since=" + cursor)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		Expect(json.NewDecoder(response.Body).Decode(&changes)).To(Succeed())
+		Expect(changes.Instances).To(BeEmpty())
+
+		response = PostHub("/api/silences", map[string]string{
+			"deployment": "some-deployment",
+			"reason":     "some-reason",
+			"ends_at":    time.Now().Add(time.Hour).Format(time.RFC3339),
+		})
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		response = HubGet("/api/health?since=" + cursor)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			ContainSubstring(`"instance_id":"some-id"`),
+			ContainSubstring(`"reason":"some-reason"`),
+		))
+	})
+
+	It("removes deregistered, deleted and long missing instances", func() {
+		cfg.Hub.StaleAfter = 2 * time.Second
+		cfg.Hub.PruneAfter = 24 * time.Hour
+
+		hubSession = StartHubWithConfig(cfg)
+
+		for _, id := range []string{"some-id", "some-other-id", "some-missing-id"} {
+			systemInfo.Spec.ID = id
+			response := PostHub("/api/health", systemInfo)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		systemInfo.Spec.ID = "some-deleted-id"
+		systemInfo.Spec.Deployment = "some-deleted-deployment"
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		sqlxClient = GetDBClient(dataDir)
+		_, err := sqlxClient.Exec("update metrics set updated_at = $1 where instance_id = $2",
+			DBTime(time.Now().Add(-48*time.Hour)), "some-missing-id")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(HubDelete("/api/health/some-id")).To(Equal(http.StatusOK))
+		Expect(HubDelete("/api/health/some-id")).To(Equal(http.StatusNotFound))
+		Expect(HubDelete("/api/deployments/some-deleted-deployment")).To(Equal(http.StatusOK))
+
+		Eventually(func() []string {
+			var instanceIDs []string
+			err := sqlxClient.Select(&instanceIDs, "select instance_id from metrics order by instance_id")
+			Expect(err).NotTo(HaveOccurred())
+			return instanceIDs
+		}).Should(Equal([]string{"some-other-id"}))
+
+		response = HubGet("/api/health?since=0")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(ContainSubstring(`"removed":["some-deleted-id","some-id","some-missing-id"]`))
+
+		response = HubGet("/api/events")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err = ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			ContainSubstring(`"kind":"removed","message":"deregistered"`),
+			ContainSubstring(`"kind":"removed","message":"deployment deleted"`),
+			ContainSubstring(`"kind":"removed","message":"missing for more than 24h0m0s"`),
+		))
+	})
+
+	It("reconciles the instances that report with those the director expects", func() {
+		director := StartFakeDirector(map[string][]FakeDirectorInstance{
+			"some-deployment": {
+				{ID: "some-id", Job: "some-group", Index: 0, AZ: "z1", ExpectsVM: true},
+				{ID: "some-missing-id", Job: "some-group", Index: 1, AZ: "z2", ExpectsVM: true},
+				{ID: "some-stopped-id", Job: "some-group", Index: 2, AZ: "z3", ExpectsVM: false},
+			},
+		})
+		defer director.Close()
+
+		cfg.Hub.Director = config.Director{
+			URL:          director.URL,
+			ClientID:     "some-client",
+			ClientSecret: "some-secret",
+			CACert:       director.CACert,
+			Interval:     time.Second,
+		}
+
+		hubSession = StartHubWithConfig(cfg)
+
+		for _, id := range []string{"some-id", "some-orphan-id"} {
+			systemInfo.Spec.ID = id
+			response := PostHub("/api/health", systemInfo)
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		Eventually(func() string {
+			response := HubGet("/api/reconciliation")
+			contents, _ := ioutil.ReadAll(response.Body)
+			return string(contents)
+		}).Should(SatisfyAll(
+			ContainSubstring(`{"instance_id":"some-missing-id","state":"missing_agent","deployment":"some-deployment","name":"some-group","instance_index":1,"az":"z2"`),
+			ContainSubstring(`{"instance_id":"some-orphan-id","state":"orphaned"`),
+			Not(ContainSubstring(`"instance_id":"some-id"`)),
+			Not(ContainSubstring(`"instance_id":"some-stopped-id"`)),
+		))
+
+		response := HubGet("/api/health")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(SatisfyAll(
+			MatchRegexp(`"instance_id":"some-missing-id",[^}]*"status":"missing_agent"`),
+			MatchRegexp(`"instance_id":"some-orphan-id",[^}]*"orphaned":true`),
+		))
+
+		systemInfo.Spec.ID = "some-missing-id"
+		response = PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		response = HubGet("/api/reconciliation")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err = ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).ShouldNot(ContainSubstring(`"instance_id":"some-missing-id"`))
+	})
+
+	It("GET /api/health?since= lists missing agents the director stopped expecting as removed", func() {
+		director := StartFakeDirector(map[string][]FakeDirectorInstance{
+			"some-deployment": {
+				{ID: "some-id", Job: "some-group", Index: 0, AZ: "z1", ExpectsVM: true},
+				{ID: "some-missing-id", Job: "some-group", Index: 1, AZ: "z2", ExpectsVM: true},
+			},
+		})
+		defer director.Close()
+
+		cfg.Hub.Director = config.Director{
+			URL:          director.URL,
+			ClientID:     "some-client",
+			ClientSecret: "some-secret",
+			CACert:       director.CACert,
+			Interval:     time.Second,
+		}
+
+		hubSession = StartHubWithConfig(cfg)
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		var changes struct {
+			Cursor    string            `json:"cursor"`
+			Instances []json.RawMessage `json:"instances"`
+			Removed   []string          `json:"removed"`
+		}
+
+		Eventually(func() int {
+			response := HubGet("/api/health?since=0")
+			Expect(json.NewDecoder(response.Body).Decode(&changes)).To(Succeed())
+			return len(changes.Instances)
+		}).Should(Equal(2))
+
+		cursor := changes.Cursor
+
+		director.SetInstances("some-deployment", []FakeDirectorInstance{
+			{ID: "some-id", Job: "some-group", Index: 0, AZ: "z1", ExpectsVM: true},
+		})
+
+		Eventually(func() []string {
+			response := HubGet("/api/health?since=" + cursor)
+			Expect(json.NewDecoder(response.Body).Decode(&changes)).To(Succeed())
+			return changes.Removed
+		}).Should(Equal([]string{"some-missing-id"}))
+	})
+
+	It("pulls the stats of agentless deployments from the director", func() {
+		director := StartFakeDirector(map[string][]FakeDirectorInstance{
+			"some-agentless-deployment": {
+				{
+					ID: "some-agentless-id", Job: "some-group", Index: 0, AZ: "z1", ExpectsVM: true,
+					Vitals: json.RawMessage(`{
+						"cpu": {"sys": "1.0", "user": "3.0", "wait": "0.5"},
+						"mem": {"kb": "1024", "percent": "35"},
+						"swap": {"kb": "0", "percent": "2"},
+						"load": ["0.01", "0.02", "0.05"],
+						"disk": {"system": {"percent": "45"}, "ephemeral": {"percent": "3"}, "persistent": {"percent": "12"}},
+						"uptime": {"secs": 3600}
+					}`),
+				},
+				{ID: "some-stopped-id", Job: "some-group", Index: 1, AZ: "z2"},
+			},
+		})
+		defer director.Close()
+
+		cfg.Hub.Director = config.Director{
+			URL:            director.URL,
+			ClientID:       "some-client",
+			ClientSecret:   "some-secret",
+			CACert:         director.CACert,
+			Agentless:      []string{"some-agentless-deployment"},
+			VitalsInterval: time.Second,
+		}
+
+		hubSession = StartHubWithConfig(cfg)
+
+		Eventually(func() string {
+			response := HubGet("/api/health")
+			contents, _ := ioutil.ReadAll(response.Body)
+			return string(contents)
+		}).Should(SatisfyAll(
+			MatchRegexp(`"instance_id":"some-agentless-id","name":"some-group",[^}]*"az":"z1","deployment":"some-agentless-deployment",[^}]*"ip":"10.0.0.1"`),
+			ContainSubstring(`"cpu_used":4.5,"memory_used":35,"persistent_disk_used":12,"load_15":0.05,"uptime":3600`),
+			ContainSubstring(`"status":"healthy"`),
+			ContainSubstring(`"source":"director","swap_used":2,"system_disk_used":45,"ephemeral_disk_used":3,"process_state":"running","processes":[{"name":"some-process","state":"running"}]`),
+			Not(ContainSubstring(`"instance_id":"some-stopped-id"`)),
+		))
+
+		response := PostHub("/api/health", systemInfo)
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		response = HubGet("/api/health")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		contents, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(contents)).Should(MatchRegexp(`"instance_id":"some-id",[^}]*"source":"agent"`))
+	})
+
+	It("marks agentless instances whose processes are not running as failing", func() {
+		director := StartFakeDirector(map[string][]FakeDirectorInstance{
+			"some-agentless-deployment": {
+				{
+					ID: "some-agentless-id", Job: "some-group", Index: 0, AZ: "z1", ExpectsVM: true,
+					ProcessState: "unresponsive agent",
+					Vitals:       json.RawMessage(`{"cpu": {"sys": "1.0", "user": "3.0", "wait": "0.5"}, "mem": {"percent": "35"}}`),
+				},
+			},
+		})
+		defer director.Close()
+
+		cfg.Hub.Director = config.Director{
+			URL:            director.URL,
+			ClientID:       "some-client",
+			ClientSecret:   "some-secret",
+			CACert:         director.CACert,
+			Agentless:      []string{"some-agentless-deployment"},
+			VitalsInterval: time.Second,
+		}
+
+		hubSession = StartHubWithConfig(cfg)
+
+		Eventually(func() string {
+			response := HubGet("/api/health")
+			contents, _ := ioutil.ReadAll(response.Body)
+			return string(contents)
+		}).Should(SatisfyAll(
+			MatchRegexp(`"instance_id":"some-agentless-id",[^}]*"status":"failing"`),
+			ContainSubstring(`"process_state":"unresponsive agent"`),
+		))
+	})
 })
@@ -8,9 +8,9 @@ import (
 	"github.com/onsi/gomega/gexec"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"testing"
-	"github.com/aemengo/bosh-deployment-dashboard/info"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -22,6 +22,12 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"net"
 	"github.com/onsi/gomega/gbytes"
+	"bufio"
+	"strings"
+	"net/http/httptest"
+	"encoding/pem"
+	"sort"
+	"sync"
 )
 
 var (
@@ -59,12 +65,30 @@ func StartAgentWithConfig(cfg config.Config) *gexec.Session {
 	return session
 }
 
-func StartHubWithConfig(cfg config.Config) *gexec.Session {
+// RunAgentPreStop runs the pre-stop of the agent the way BOSH would, with
+// the given environment.
+func RunAgentPreStop(cfg config.Config, env ...string) *gexec.Session {
+	contents, _ := yaml.Marshal(cfg)
+	ioutil.WriteFile("/tmp/bdd-agent-test-config.yml", contents, 0600)
+	cmd := exec.Command(agentBinaryPath, "pre-stop", "/tmp/bdd-agent-test-config.yml")
+	cmd.Env = append(os.Environ(), env...)
+	session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+	Expect(err).NotTo(HaveOccurred())
+	return session
+}
+
+// RunHubWithConfig starts the hub without waiting for it to serve.
+func RunHubWithConfig(cfg config.Config) *gexec.Session {
 	contents, _ := yaml.Marshal(cfg)
 	ioutil.WriteFile("/tmp/bdd-hub-test-config.yml", contents, 0600)
 	cmd := exec.Command(hubBinaryPath, "/tmp/bdd-hub-test-config.yml")
 	session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
 	Expect(err).NotTo(HaveOccurred())
+	return session
+}
+
+func StartHubWithConfig(cfg config.Config) *gexec.Session {
+	session := RunHubWithConfig(cfg)
 
 	//wait for server to create database tables
 	Eventually(session).Should(gbytes.Say(`Initializing hub on addr`))
@@ -77,7 +101,7 @@ func StartHubWithConfig(cfg config.Config) *gexec.Session {
 	return session
 }
 
-func PostHub(path string, body info.Info) *http.Response {
+func PostHub(path string, body interface{}) *http.Response {
 	contents, _ := json.Marshal(body)
 	url := fmt.Sprintf("http://127.0.0.1:%s%s", hubPort, path)
 	response, err := http.Post(url, "application/json", bytes.NewReader(contents))
@@ -97,3 +121,273 @@ func GetDBClient(dataDir string) *sqlx.DB {
 	Expect(err).NotTo(HaveOccurred())
 	return sqlx.NewDb(db, "sqlite3")
 }
+
+// DBTime formats t the way the hub stores timestamps.
+func DBTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// SeedHistory stores stats of an instance in the history of the hub, as
+// if the instance had reported them at createdAt.
+func SeedHistory(db *sqlx.DB, instanceID string, createdAt time.Time, stats map[string]float64) {
+	var (
+		columns      = []string{"instance_id", "created_at"}
+		placeholders = []string{"$1", "$2"}
+		values       = []interface{}{instanceID, DBTime(createdAt)}
+	)
+
+	for stat, value := range stats {
+		columns = append(columns, stat)
+		values = append(values, value)
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(values)))
+	}
+
+	_, err := db.Exec(fmt.Sprintf("insert into history (%s) values (%s)",
+		strings.Join(columns, ", "), strings.Join(placeholders, ", ")), values...)
+	Expect(err).NotTo(HaveOccurred())
+}
+
+// SeedStatus records in the status history of the hub that an instance
+// changed to status at startedAt.
+func SeedStatus(db *sqlx.DB, instanceID string, status string, startedAt time.Time) {
+	_, err := db.Exec("insert into status_history (instance_id, status, started_at) values ($1, $2, $3)",
+		instanceID, status, DBTime(startedAt))
+	Expect(err).NotTo(HaveOccurred())
+}
+
+// HubDelete sends a DELETE for path to the hub and returns its status.
+func HubDelete(path string) int {
+	request, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://127.0.0.1:%s%s", hubPort, path), nil)
+	Expect(err).NotTo(HaveOccurred())
+
+	response, err := http.DefaultClient.Do(request)
+	Expect(err).NotTo(HaveOccurred())
+	response.Body.Close()
+	return response.StatusCode
+}
+
+// StartFakeSMTPServer accepts mail on a random local port and passes every
+// message it receives on the returned channel.
+func StartFakeSMTPServer() (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+
+	messages := make(chan string, 10)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSMTP(conn, messages)
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port, messages
+}
+
+// StartStalledSMTPServer accepts connections on a random local port, but
+// never answers on them, like a mail server that hangs.
+func StartStalledSMTPServer() string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+func serveFakeSMTP(conn net.Conn, messages chan string) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "220 fake-smtp\r\n")
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		switch strings.ToUpper(strings.Fields(line + " ")[0]) {
+		case "DATA":
+			fmt.Fprint(conn, "354 go ahead\r\n")
+
+			var message bytes.Buffer
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+				message.WriteString(line)
+			}
+
+			messages <- message.String()
+			fmt.Fprint(conn, "250 ok\r\n")
+		case "QUIT":
+			fmt.Fprint(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "250 ok\r\n")
+		}
+	}
+}
+
+// FakeDirectorInstance is an instance as the fake director lists it.
+// Vitals, the JSON the director keeps about its VM, and ProcessState,
+// running unless set, are only listed in full.
+type FakeDirectorInstance struct {
+	ID           string          `json:"id"`
+	Job          string          `json:"job"`
+	Index        int             `json:"index"`
+	AZ           string          `json:"az"`
+	ExpectsVM    bool            `json:"expects_vm"`
+	Vitals       json.RawMessage `json:"-"`
+	ProcessState string          `json:"-"`
+}
+
+// FakeDirector serves the parts of the BOSH Director and UAA APIs the hub
+// uses over TLS, for the client some-client with secret some-secret.
+type FakeDirector struct {
+	*httptest.Server
+	CACert string
+
+	lock        sync.Mutex
+	deployments map[string][]FakeDirectorInstance
+}
+
+// SetInstances changes the instances the fake director lists for a
+// deployment.
+func (d *FakeDirector) SetInstances(deployment string, instances []FakeDirectorInstance) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.deployments[deployment] = instances
+}
+
+// StartFakeDirector lists the instances of each deployment it is given.
+// Listing them in full runs a task, like on a real director.
+func StartFakeDirector(deployments map[string][]FakeDirectorInstance) *FakeDirector {
+	var (
+		mux      = http.NewServeMux()
+		director = &FakeDirector{Server: httptest.NewUnstartedServer(mux), deployments: deployments}
+		tasks    []string
+		lock     = &director.lock
+	)
+
+	authorized := func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer some-token"
+	}
+
+	mux.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"user_authentication":{"type":"uaa","options":{"url":%q}}}`, director.URL)
+	})
+
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, ok := r.BasicAuth(); !ok || id != "some-client" || secret != "some-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"some-token","token_type":"bearer","expires_in":3600}`)
+	})
+
+	mux.HandleFunc("/deployments", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		var names []map[string]string
+		for name := range deployments {
+			names = append(names, map[string]string{"name": name})
+		}
+		sort.Slice(names, func(i, j int) bool { return names[i]["name"] < names[j]["name"] })
+
+		json.NewEncoder(w).Encode(names)
+	})
+
+	mux.HandleFunc("/deployments/", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/deployments/"), "/")
+		instances, ok := deployments[parts[0]]
+		if !ok || len(parts) != 2 || parts[1] != "instances" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if r.URL.Query().Get("format") == "full" {
+			tasks = append(tasks, parts[0])
+			http.Redirect(w, r, fmt.Sprintf("/tasks/%d", len(tasks)), http.StatusFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(instances)
+	})
+
+	mux.HandleFunc("/tasks/", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var id int
+		fmt.Sscanf(strings.TrimPrefix(r.URL.Path, "/tasks/"), "%d", &id)
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		if id < 1 || id > len(tasks) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if !strings.HasSuffix(r.URL.Path, "/output") {
+			fmt.Fprintf(w, `{"id":%d,"state":"done","result":""}`, id)
+			return
+		}
+
+		for _, i := range deployments[tasks[id-1]] {
+			processState := i.ProcessState
+			if processState == "" {
+				processState = "running"
+			}
+
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":            i.ID,
+				"job_name":      i.Job,
+				"index":         i.Index,
+				"az":            i.AZ,
+				"ips":           []string{"10.0.0.1"},
+				"expects_vm":    i.ExpectsVM,
+				"process_state": processState,
+				"processes":     []map[string]string{{"name": "some-process", "state": "running"}},
+				"vitals":        i.Vitals,
+			})
+		}
+	})
+
+	director.StartTLS()
+	director.CACert = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: director.Certificate().Raw}))
+	return director
+}
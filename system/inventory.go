@@ -0,0 +1,134 @@
+package system
+
+import (
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/host"
+	"github.com/shirou/gopsutil/mem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	stemcellDir = "/var/vcap/bosh/etc"
+	jobsDir     = "/var/vcap/jobs"
+	packagesDir = "/var/vcap/packages"
+	diskPaths   = []string{"/", "/var/vcap/data", "/var/vcap/store"}
+)
+
+type Disk struct {
+	Path  string `json:"path"`
+	Total uint64 `json:"total"`
+}
+
+type Inventory struct {
+	CPUCount        int               `json:"cpu_count"`
+	CPUModel        string            `json:"cpu_model"`
+	MemoryTotal     uint64            `json:"memory_total"`
+	Disks           []Disk            `json:"disks"`
+	KernelVersion   string            `json:"kernel_version"`
+	OS              string            `json:"os"`
+	StemcellVersion string            `json:"stemcell_version"`
+	Stemcell        map[string]string `json:"stemcell,omitempty"`
+	AgentVersion    string            `json:"agent_version"`
+	Jobs            map[string]string `json:"jobs,omitempty"`
+	Packages        map[string]string `json:"packages,omitempty"`
+	ConfigHashes    map[string]string `json:"config_hashes,omitempty"`
+}
+
+func GetInventory() (Inventory, error) {
+	c, err := cpu.Info()
+	if err != nil {
+		return Inventory{}, err
+	}
+
+	v, err := mem.VirtualMemory()
+	if err != nil {
+		return Inventory{}, err
+	}
+
+	h, err := host.Info()
+	if err != nil {
+		return Inventory{}, err
+	}
+
+	var disks []Disk
+
+	for _, path := range diskPaths {
+		if !fileExists(path) {
+			continue
+		}
+
+		d, err := disk.Usage(path)
+		if err != nil {
+			return Inventory{}, err
+		}
+		disks = append(disks, Disk{Path: path, Total: d.Total})
+	}
+
+	var cpuModel string
+	if len(c) > 0 {
+		cpuModel = c[0].ModelName
+	}
+
+	stemcell := readStemcellFiles(stemcellDir)
+
+	return Inventory{
+		CPUCount:        len(c),
+		CPUModel:        cpuModel,
+		MemoryTotal:     v.Total,
+		Disks:           disks,
+		KernelVersion:   h.KernelVersion,
+		OS:              strings.TrimSpace(h.Platform + " " + h.PlatformVersion),
+		StemcellVersion: stemcell["version"],
+		Stemcell:        stemcell,
+		Jobs:            readVersions(jobsDir),
+		Packages:        readVersions(packagesDir),
+	}, nil
+}
+
+// readStemcellFiles collects the stemcell_* files that BOSH lays down on
+// every VM, keyed by their suffix (e.g. "version", "git_sha1").
+func readStemcellFiles(dir string) map[string]string {
+	paths, _ := filepath.Glob(filepath.Join(dir, "stemcell_*"))
+
+	files := map[string]string{}
+	for _, path := range paths {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		key := strings.TrimPrefix(filepath.Base(path), "stemcell_")
+		files[key] = strings.TrimSpace(string(contents))
+	}
+
+	return files
+}
+
+// readVersions maps every job or package in dir to its version. BOSH
+// symlinks each entry to a directory named after the version fingerprint,
+// e.g. /var/vcap/jobs/uaa -> /var/vcap/data/jobs/uaa/<fingerprint>.
+func readVersions(dir string) map[string]string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	versions := map[string]string{}
+	for _, entry := range entries {
+		if entry.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		target, err := os.Readlink(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		versions[entry.Name()] = filepath.Base(target)
+	}
+
+	return versions
+}
@@ -0,0 +1,101 @@
+package system
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// HashJobConfigs returns a sha256 of every rendered file under
+// /var/vcap/jobs/*/config matching the include patterns, keyed by its path
+// relative to /var/vcap/jobs. Only the hashes ever leave the VM, never the
+// file contents. Rendered templates differ per instance in values such as
+// the IP, index and spec.id, so nothing is hashed unless files are
+// included explicitly. Files that cannot be read are left out, and are
+// listed in the error next to the hashes of the others.
+func HashJobConfigs(include, exclude []string) (map[string]string, error) {
+	return hashJobConfigs(jobsDir, include, exclude)
+}
+
+func hashJobConfigs(dir string, include, exclude []string) (map[string]string, error) {
+	if len(include) == 0 {
+		return nil, nil
+	}
+
+	configDirs, err := filepath.Glob(filepath.Join(dir, "*", "config"))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		hashes     = map[string]string{}
+		unreadable []string
+	)
+
+	for _, configDir := range configDirs {
+		filepath.Walk(configDir, func(path string, info os.FileInfo, err error) error {
+			relPath, _ := filepath.Rel(dir, path)
+
+			if err != nil {
+				unreadable = append(unreadable, relPath)
+				return nil
+			}
+
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			if !matchesAny(include, relPath) || matchesAny(exclude, relPath) {
+				return nil
+			}
+
+			hash, err := hashFile(path)
+			if err != nil {
+				unreadable = append(unreadable, relPath)
+				return nil
+			}
+			hashes[relPath] = hash
+
+			return nil
+		})
+	}
+
+	if len(unreadable) > 0 {
+		return hashes, fmt.Errorf("unable to read %s", strings.Join(unreadable, ", "))
+	}
+
+	return hashes, nil
+}
+
+func matchesAny(patterns []string, relPath string) bool {
+	for _, pattern := range patterns {
+		name := relPath
+		if !strings.Contains(pattern, "/") {
+			name = filepath.Base(relPath)
+		}
+
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,67 @@
+package system
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("HashJobConfigs", func() {
+
+	var dir string
+
+	writeFile := func(relPath string, contents string) {
+		path := filepath.Join(dir, relPath)
+		Expect(os.MkdirAll(filepath.Dir(path), 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "bdd-jobs-")
+		Expect(err).NotTo(HaveOccurred())
+
+		writeFile("some-job/config/some-job.yml", "some-contents")
+		writeFile("some-job/config/bpm.yml", "some-contents")
+		writeFile("some-job/bin/ctl", "some-contents")
+		writeFile("other-job/config/other-job.yml", "other-contents")
+	})
+
+	AfterEach(func() {
+		os.Chmod(filepath.Join(dir, "other-job/config/other-job.yml"), 0600)
+		os.RemoveAll(dir)
+	})
+
+	It("hashes the included config files, but not the excluded ones", func() {
+		hashes, err := hashJobConfigs(dir, []string{"*.yml"}, []string{"bpm.yml"})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(hashes).To(Equal(map[string]string{
+			"some-job/config/some-job.yml":   "6e32ea34db1b3755d7dec972eb72c705338f0dd8e0be881d966963438fb2e800",
+			"other-job/config/other-job.yml": "a70d57ef8180c6a8940ed7f3e2fd730c98b810963cf3d2ce9df5db45f79a1d11",
+		}))
+	})
+
+	It("hashes nothing without include patterns", func() {
+		hashes, err := hashJobConfigs(dir, nil, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hashes).To(BeEmpty())
+	})
+
+	It("leaves out files it cannot read, and hashes the others", func() {
+		if os.Geteuid() == 0 {
+			Skip("root reads files regardless of their mode")
+		}
+
+		Expect(os.Chmod(filepath.Join(dir, "other-job/config/other-job.yml"), 0)).To(Succeed())
+
+		hashes, err := hashJobConfigs(dir, []string{"*.yml"}, nil)
+		Expect(err).To(MatchError("unable to read other-job/config/other-job.yml"))
+
+		Expect(hashes).To(HaveKey("some-job/config/some-job.yml"))
+		Expect(hashes).NotTo(HaveKey("other-job/config/other-job.yml"))
+	})
+})
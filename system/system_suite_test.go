@@ -0,0 +1,13 @@
+package system
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSystem(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "System Suite")
+}
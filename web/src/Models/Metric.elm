@@ -1,6 +1,6 @@
 module Metric exposing (Metric, decodeMetrics)
 
-import Json.Decode exposing (Decoder, string, int, float, list)
+import Json.Decode exposing (Decoder, string, int, float, bool, list)
 import Json.Decode.Pipeline exposing (decode, required, optional, hardcoded)
 
 type alias Metric =
@@ -20,6 +20,9 @@ type alias Metric =
     , uptime : Int
     , updatedAt : String
     , details : String
+    , drifted : Bool
+    , status : String
+    , orphaned : Bool
     }
 
 decodeMetric : Decoder Metric
@@ -40,7 +43,10 @@ decodeMetric =
         |> required "load_15" float
         |> required "uptime" int
         |> hardcoded ""
-        |> optional "details" string "no details!"
+        |> optional "details" string ""
+        |> optional "drifted" bool False
+        |> optional "status" string ""
+        |> optional "orphaned" bool False
 
 decodeMetrics : Decoder (List Metric)
 decodeMetrics =
@@ -16,7 +16,10 @@ message status =
 
 fromMetric : Metric -> Status
 fromMetric metric =
-    Running
+    if metric.drifted || metric.orphaned || metric.status == "failing" || metric.status == "stale" || metric.status == "missing_agent" then
+        NeedsAttention
+    else
+        Running
 
 fromMetrics : List Metric -> Status
 fromMetrics metrics =
@@ -93,6 +93,9 @@ metricsAccordionBlock metricGroup metrics =
                     Grid.row []
                         [ Grid.col [] [ table ]
                         ]
+                ,   Grid.row []
+                        [ Grid.col [] (detailsFrom filteredMetrics)
+                        ]
                 ]
     in
         Accordion.block [] [